@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+const (
+	// EnvAdvertiseAddr is the environment variable of advertised address, host or host:port.
+	EnvAdvertiseAddr = "ADVERTISE_ADDR"
+	// EnvPodIP is the environment variable of pod IP, usually set by kubernetes downward API.
+	EnvPodIP = "POD_IP"
+)
+
+var interfaceAddrs = net.InterfaceAddrs
+
+// advertiseEndpoint replaces the unspecified or loopback host of the endpoint with an advertisable address,
+// and applies the host and port mappings. The host is kept if no advertisable address is found.
+func (o *options) advertiseEndpoint(endpoint string) (string, error) {
+	e, err := registry.ParseEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	host, port := e.Host, e.Port
+
+	if h, ok := o.hostMappings[host]; ok {
+		host = h
+	} else if !isAdvertisable(host) {
+		host, port, err = o.detectAdvertiseAddr(host, port)
+		if err != nil {
+			return "", err
+		}
+	}
+	if p, ok := o.portMappings[port]; ok {
+		port = p
+	}
+
+	e.Host, e.Port = host, port
+	return e.String(), nil
+}
+
+// detectAdvertiseAddr returns the advertised address in order of WithAdvertiseAddr, ADVERTISE_ADDR, POD_IP,
+// the first interface address in the preferred CIDRs, and the first non-loopback interface address,
+// the host is returned with a warning if there is no non-loopback interface address, e.g. in a container with only lo.
+func (o *options) detectAdvertiseAddr(host string, port int) (string, int, error) {
+	if o.advertiseHost != "" {
+		return o.advertiseHost, port, nil
+	}
+
+	if addr := os.Getenv(EnvAdvertiseAddr); addr != "" {
+		host, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return addr, port, nil //nolint
+		}
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port of %s=%s", EnvAdvertiseAddr, addr)
+		}
+		return host, port, nil
+	}
+
+	if ip := os.Getenv(EnvPodIP); ip != "" {
+		return ip, port, nil
+	}
+
+	ip, err := detectIP(o.preferredCIDRs)
+	if err != nil {
+		fmt.Printf("[driver] warning: %v, register with host %s\n", err, host)
+		return host, port, nil
+	}
+	return ip, port, nil
+}
+
+// detectIP returns the first interface address in cidrs, if not found, returns the first non-loopback
+// interface address, IPv4 is preferred.
+func detectIP(cidrs []*net.IPNet) (string, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsUnspecified() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+
+	for _, cidr := range cidrs {
+		for _, ip := range ips {
+			if cidr.Contains(ip) {
+				return ip.String(), nil
+			}
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	if len(ips) > 0 {
+		return ips[0].String(), nil
+	}
+	return "", fmt.Errorf("no advertisable address found, set %s or %s", EnvAdvertiseAddr, EnvPodIP)
+}
+
+// isAdvertisable reports whether the host can be reached by other machines.
+func isAdvertisable(host string) bool {
+	if host == "" || strings.EqualFold(host, "localhost") {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true // domain name
+	}
+	return !ip.IsUnspecified() && !ip.IsLoopback()
+}
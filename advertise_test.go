@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_advertiseEndpoint(t *testing.T) {
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("192.168.3.27"), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+	defer func() { interfaceAddrs = net.InterfaceAddrs }()
+	t.Setenv(EnvAdvertiseAddr, "")
+	t.Setenv(EnvPodIP, "")
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		env      map[string]string
+		endpoint string
+		want     string
+	}{
+		{"advertisable", nil, nil, "grpc://192.168.3.27:36790", "grpc://192.168.3.27:36790"},
+		{"first interface", nil, nil, "grpc://0.0.0.0:36790", "grpc://10.0.0.5:36790"},
+		{"preferred cidr", []Option{WithPreferredCIDR("192.168.0.0/16")}, nil, "grpc://localhost:36790", "grpc://192.168.3.27:36790"},
+		{"upper case localhost", nil, nil, "grpc://LocalHost:36790", "grpc://10.0.0.5:36790"},
+		{"pod ip", nil, map[string]string{EnvPodIP: "172.16.0.8"}, "grpc://[::]:36790", "grpc://172.16.0.8:36790"},
+		{"advertise addr", nil, map[string]string{EnvAdvertiseAddr: "foobar.com:46790", EnvPodIP: "172.16.0.8"}, "http://127.0.0.1:36789", "http://foobar.com:46790"},
+		{"advertise host", []Option{WithAdvertiseHost("foobar.com")}, map[string]string{EnvPodIP: "172.16.0.8"}, "grpc://0.0.0.0:36790", "grpc://foobar.com:36790"},
+		{"mapping", []Option{WithHostMapping("192.168.3.27", "1.2.3.4"), WithPortMapping(36790, 46790)}, nil, "grpc://192.168.3.27:36790", "grpc://1.2.3.4:46790"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			o := defaultOptions()
+			o.apply(tt.opts...)
+			got, err := o.advertiseEndpoint(tt.endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_advertiseEndpointLoopbackOnly(t *testing.T) {
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)}}, nil
+	}
+	defer func() { interfaceAddrs = net.InterfaceAddrs }()
+	t.Setenv(EnvAdvertiseAddr, "")
+	t.Setenv(EnvPodIP, "")
+
+	// the configured host is registered if there is no advertisable address
+	got, err := defaultOptions().advertiseEndpoint("grpc://127.0.0.1:36790")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "grpc://127.0.0.1:36790"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,167 @@
+package driver
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/discovery"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// registration is a registration of dtm service made by the driver.
+type registration struct {
+	target       string
+	registryType string
+	instance     *registry.ServiceInstance
+	iRegistry    registry.Registry
+	manager      *registry.Manager // not nil if the registration follows the health of dtm service
+	registeredAt time.Time
+	err          error
+	status       string // draining or deregistered after Drain, guarded by the mutex of driver
+}
+
+// RegistrationState is the state of a registration of dtm service.
+type RegistrationState struct {
+	Registry      string    `json:"registry"`
+	Target        string    `json:"target"`
+	ServiceName   string    `json:"serviceName"`
+	InstanceID    string    `json:"instanceID"`
+	Endpoints     []string  `json:"endpoints"`
+	Status        string    `json:"status"` // registered, unhealthy, draining, deregistered or failed
+	Error         string    `json:"error,omitempty"`
+	RegisteredAt  time.Time `json:"registeredAt"`
+	LeaseID       int64     `json:"leaseID,omitempty"` // etcd only
+	LastHeartbeat time.Time `json:"lastHeartbeat"`     // etcd and consul only
+}
+
+// DebugState is the state of registrations and resolvers.
+type DebugState struct {
+	Registrations []RegistrationState       `json:"registrations"`
+	Resolvers     []discovery.ResolverState `json:"resolvers"`
+}
+
+type leaseStater interface {
+	LeaseID() int64
+}
+
+type heartbeatStater interface {
+	LastHeartbeat() time.Time
+}
+
+func (d *SpongeDriver) addRegistration(r *registration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.registrations = append(d.registrations, r)
+}
+
+// DebugState returns the state of registrations made by the driver and all active resolvers.
+func (d *SpongeDriver) DebugState() *DebugState {
+	d.mu.Lock()
+	registrations := make([]*registration, len(d.registrations))
+	copy(registrations, d.registrations)
+	statuses := make([]string, len(d.registrations))
+	for i, r := range d.registrations {
+		statuses[i] = r.status
+	}
+	d.mu.Unlock()
+
+	state := &DebugState{
+		Registrations: make([]RegistrationState, 0, len(registrations)),
+		Resolvers:     discovery.Resolvers(),
+	}
+	for i, r := range registrations {
+		rs := RegistrationState{
+			Registry:     r.registryType,
+			Target:       redactTarget(r.target),
+			Status:       "registered",
+			RegisteredAt: r.registeredAt,
+		}
+		if r.instance != nil {
+			rs.ServiceName = r.instance.Name
+			rs.InstanceID = r.instance.ID
+			rs.Endpoints = r.instance.Endpoints
+		}
+		if r.manager != nil && !r.manager.Registered() {
+			rs.Status = "unhealthy"
+		}
+		if statuses[i] != "" {
+			rs.Status = statuses[i]
+		}
+		if r.err != nil {
+			rs.Status = "failed"
+			rs.Error = r.err.Error()
+		}
+		iRegistry := registry.UnwrapRegistry(r.iRegistry)
+		if ls, ok := iRegistry.(leaseStater); ok {
+			rs.LeaseID = ls.LeaseID()
+		}
+		if hs, ok := iRegistry.(heartbeatStater); ok {
+			rs.LastHeartbeat = hs.LastHeartbeat()
+		}
+		state.Registrations = append(state.Registrations, rs)
+	}
+	return state
+}
+
+// DebugHandler returns a handler that shows the registrations and resolvers of the driver registered to dtm.
+func DebugHandler() http.Handler {
+	return defaultDriver.DebugHandler()
+}
+
+// DebugHandler returns a handler that shows the registrations made by the driver and all active resolvers,
+// the response is json if the query parameter format=json is set or json is accepted, otherwise html.
+func (d *SpongeDriver) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := d.DebugState()
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_ = json.NewEncoder(w).Encode(state)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := debugTemplate.Execute(w, state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// redactTarget hides the credentials in the target.
+func redactTarget(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	params := u.Query()
+	for _, key := range []string{"token", "password"} {
+		if params.Get(key) != "" {
+			params.Set(key, "xxxxx")
+		}
+	}
+	u.RawQuery = params.Encode()
+	return u.Redacted()
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>dtm driver sponge</title></head>
+<body>
+<h2>Registrations</h2>
+<table border="1" cellpadding="4">
+<tr><th>Registry</th><th>Target</th><th>Service</th><th>Instance ID</th><th>Endpoints</th><th>Status</th><th>Registered At</th><th>Lease ID</th><th>Last Heartbeat</th></tr>
+{{range .Registrations}}<tr><td>{{.Registry}}</td><td>{{.Target}}</td><td>{{.ServiceName}}</td><td>{{.InstanceID}}</td><td>{{range .Endpoints}}{{.}}<br>{{end}}</td><td>{{.Status}} {{.Error}}</td><td>{{.RegisteredAt.Format "2006-01-02 15:04:05"}}</td><td>{{if .LeaseID}}{{.LeaseID}}{{end}}</td><td>{{if not .LastHeartbeat.IsZero}}{{.LastHeartbeat.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+{{end}}</table>
+<h2>Resolvers</h2>
+{{range .Resolvers}}<h3>{{.ServiceName}} ({{.Target}})</h3>
+<p>last update: {{if not .LastUpdate.IsZero}}{{.LastUpdate.Format "2006-01-02 15:04:05"}}{{end}}{{if .LastError}}, last error: {{.LastError}} at {{.LastErrorAt.Format "2006-01-02 15:04:05"}}{{end}}</p>
+<table border="1" cellpadding="4">
+<tr><th>Address</th><th>Instance ID</th><th>Version</th><th>Metadata</th></tr>
+{{range .Addresses}}<tr><td>{{.Addr}}</td><td>{{.InstanceID}}</td><td>{{.Version}}</td><td>{{range $k, $v := .Metadata}}{{$k}}={{$v}}<br>{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
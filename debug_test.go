@@ -0,0 +1,42 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+func TestSpongeDriver_DebugHandler(t *testing.T) {
+	d := new(SpongeDriver)
+	d.addRegistration(&registration{
+		target:       "consul://127.0.0.1:8500/dtmservice?token=your-token",
+		registryType: consulType,
+		instance:     registry.NewServiceInstance("dtmservice_grpc_127.0.0.1_36790", "dtmservice", []string{"grpc://127.0.0.1:36790"}),
+		registeredAt: time.Now(),
+		err:          errors.New("connection refused"),
+	})
+
+	rec := httptest.NewRecorder()
+	d.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/dtmdriver?format=json", nil))
+	state := &DebugState{}
+	if err := json.Unmarshal(rec.Body.Bytes(), state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Registrations) != 1 || state.Registrations[0].Status != "failed" {
+		t.Errorf("unexpected registrations: %+v", state.Registrations)
+	}
+	if strings.Contains(state.Registrations[0].Target, "your-token") {
+		t.Errorf("token is not redacted: %s", state.Registrations[0].Target)
+	}
+
+	rec = httptest.NewRecorder()
+	d.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/dtmdriver", nil))
+	if !strings.Contains(rec.Body.String(), "dtmservice_grpc_127.0.0.1_36790") {
+		t.Error("instance ID is not found in html")
+	}
+}
@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// Drain takes dtm service registered to dtm out of rotation, see SpongeDriver.Drain.
+func Drain(ctx context.Context) error {
+	return defaultDriver.Drain(ctx)
+}
+
+// Drain takes the registered dtm service out of rotation with the native mechanism of the registry, waits for
+// the drain period so that the in-flight transactions are finished, then deregisters it. The waiting stops
+// early when ctx is done.
+func (d *SpongeDriver) Drain(ctx context.Context) error {
+	opts := d.opts
+	if opts == nil {
+		opts = defaultOptions()
+	}
+
+	d.mu.Lock()
+	var registrations []*registration
+	for _, r := range d.registrations {
+		if r.err == nil && r.iRegistry != nil && r.status == "" {
+			registrations = append(registrations, r)
+		}
+	}
+	d.mu.Unlock()
+	if len(registrations) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for _, r := range registrations {
+		if err := r.drain(ctx); err != nil {
+			errs = append(errs, err)
+		}
+		d.setStatus(r, "draining")
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(opts.drainPeriod):
+	}
+
+	deregisterCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	for _, r := range registrations {
+		if err := r.deregister(deregisterCtx); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		d.setStatus(r, "deregistered")
+	}
+	return errors.Join(errs...)
+}
+
+func (d *SpongeDriver) setStatus(r *registration, status string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r.status = status
+}
+
+// drain marks the instance as draining, the registries without drain support keep the instance in rotation
+// until it is deregistered.
+func (r *registration) drain(ctx context.Context) error {
+	drainer, ok := r.iRegistry.(registry.Drainer)
+	if !ok {
+		return nil
+	}
+	err := drainer.Drain(ctx, r.instance)
+	if err != nil && !errors.Is(err, registry.ErrDrainNotSupported) {
+		return fmt.Errorf("drain %s failed: %v", r.instance.ID, err)
+	}
+	return nil
+}
+
+func (r *registration) deregister(ctx context.Context) error {
+	var err error
+	if r.manager != nil {
+		err = r.manager.Stop(ctx)
+	} else {
+		err = r.iRegistry.Deregister(ctx, r.instance)
+	}
+	if err != nil {
+		return fmt.Errorf("deregister %s failed: %v", r.instance.ID, err)
+	}
+	return nil
+}
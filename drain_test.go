@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+type drainRegistry struct {
+	drainedAt      time.Time
+	deregisteredAt time.Time
+}
+
+func (r *drainRegistry) Register(context.Context, *registry.ServiceInstance) error {
+	return nil
+}
+
+func (r *drainRegistry) Deregister(context.Context, *registry.ServiceInstance) error {
+	r.deregisteredAt = time.Now()
+	return nil
+}
+
+func (r *drainRegistry) Drain(_ context.Context, service *registry.ServiceInstance) error {
+	if service.Metadata[registry.MetadataKeyStatus] == "" {
+		r.drainedAt = time.Now()
+	}
+	return nil
+}
+
+func TestSpongeDriver_Drain(t *testing.T) {
+	d := new(SpongeDriver)
+	d.setOptions(WithDrainPeriod(time.Millisecond * 100))
+	r := &drainRegistry{}
+	d.addRegistration(&registration{
+		target:       "etcd://127.0.0.1:2379/dtmservice",
+		registryType: etcdType,
+		instance:     registry.NewServiceInstance("dtmservice_grpc_127.0.0.1_36790", "dtmservice", []string{"grpc://127.0.0.1:36790"}),
+		iRegistry:    registry.ChainRegistry(r, registry.WithRetry(2, time.Millisecond)),
+		registeredAt: time.Now(),
+	})
+
+	if err := d.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r.drainedAt.IsZero() || r.deregisteredAt.Sub(r.drainedAt) < time.Millisecond*100 {
+		t.Fatalf("drained at %v, deregistered at %v", r.drainedAt, r.deregisteredAt)
+	}
+	if status := d.DebugState().Registrations[0].Status; status != "deregistered" {
+		t.Fatalf("got status %s, want deregistered", status)
+	}
+
+	// drained registrations are skipped
+	r.deregisteredAt = time.Time{}
+	if err := d.Drain(context.Background()); err != nil || !r.deregisteredAt.IsZero() {
+		t.Fatalf("drain again: %v", err)
+	}
+}
@@ -1,15 +1,28 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dtm-labs/dtmdriver"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 )
 
+var defaultDriver = &SpongeDriver{}
+
 func init() {
-	dtmdriver.Register(&SpongeDriver{})
+	dtmdriver.Register(defaultDriver)
+}
+
+// Setup set the options of the driver registered to dtm, it must be called before dtm invokes RegisterService.
+func Setup(opts ...Option) {
+	defaultDriver.setOptions(opts...)
 }
 
 const (
@@ -20,7 +33,24 @@ const (
 )
 
 // SpongeDriver is a dtm driver for sponge
-type SpongeDriver struct{}
+type SpongeDriver struct {
+	opts    *options
+	metrics *metrics.Metrics
+
+	mu            sync.Mutex
+	registrations []*registration
+	discoveries   map[string]registry.Discovery // named registries
+}
+
+func (d *SpongeDriver) setOptions(opts ...Option) {
+	if d.opts == nil {
+		d.opts = defaultOptions()
+	}
+	d.opts.apply(opts...)
+	if d.opts.registerer != nil {
+		d.metrics = metrics.New(d.opts.registerer)
+	}
+}
 
 // GetName returns the driver name
 func (d *SpongeDriver) GetName() string {
@@ -42,20 +72,113 @@ func (d *SpongeDriver) RegisterService(target string, endpoint string) error {
 	if err != nil {
 		return err
 	}
+	c.metrics = d.metrics
+	opts := d.opts
+	if opts == nil {
+		opts = defaultOptions()
+	}
+	c.serviceConfigInterval = opts.serviceConfigInterval
+	localEndpoint := endpoint // probed by the readiness gate
+	endpoint, err = opts.advertiseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
 	mark, err := parseEndpoint(endpoint)
 	if err != nil {
 		return err
 	}
 	id := c.name + "_" + mark
 
-	// register dtm service to consul, etcd, nacos
-	err = c.register(endpoint, id)
+	if opts.readinessProbe != nil || opts.readySignal != nil {
+		// the listener of dtm may start after RegisterService returns
+		go func() {
+			if err := opts.waitReady(localEndpoint); err != nil {
+				d.addRegistration(&registration{
+					target:       target,
+					registryType: c.Type,
+					registeredAt: time.Now(),
+					err:          err,
+				})
+				opts.registrationFailed(err)
+				return
+			}
+			if err := d.register(c, opts, target, endpoint, id); err != nil {
+				opts.registrationFailed(err)
+			}
+		}()
+	} else if err = d.register(c, opts, target, endpoint, id); err != nil {
+		return err
+	}
+
+	named, err := d.namedDiscoveries()
 	if err != nil {
 		return err
 	}
 
 	// resolver your service from consul, etcd, nacos
-	return c.resolver()
+	return c.resolver(named)
+}
+
+// register dtm service to consul, etcd, nacos and records the registration.
+func (d *SpongeDriver) register(c *driverConfig, opts *options, target string, endpoint string, id string) error {
+	r := &registration{target: target, registryType: c.Type}
+	c.hooks = d.newHooks(c.Type, opts.registrationPolicy, r)
+	iRegistry, instance, err := c.newRegistry(endpoint, id)
+	var manager *registry.Manager
+	if err == nil && opts.health != nil {
+		manager = registry.NewManager(iRegistry, instance, opts.health, opts.healthOpts...)
+	}
+	// the hooks may fire during the registration
+	d.mu.Lock()
+	r.instance, r.iRegistry, r.manager = instance, iRegistry, manager
+	d.mu.Unlock()
+
+	if err == nil {
+		if manager != nil {
+			err = manager.Start()
+		} else {
+			err = iRegistry.Register(context.Background(), instance)
+		}
+	}
+	d.mu.Lock()
+	r.registeredAt = time.Now()
+	r.err = err
+	d.mu.Unlock()
+	d.addRegistration(r)
+	return err
+}
+
+// namedDiscoveries creates the discoveries of named registries which have not been created.
+func (d *SpongeDriver) namedDiscoveries() (map[string]registry.Discovery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.opts == nil {
+		return nil, nil
+	}
+	if d.discoveries == nil {
+		d.discoveries = make(map[string]registry.Discovery)
+	}
+	for name, target := range d.opts.registries {
+		if _, ok := d.discoveries[name]; ok {
+			continue
+		}
+		c, err := parseTarget(target)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %v", name, err)
+		}
+		c.metrics = d.metrics
+		iDiscovery, err := c.newDiscovery()
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %v", name, err)
+		}
+		d.discoveries[name] = iDiscovery
+	}
+
+	named := make(map[string]registry.Discovery, len(d.discoveries))
+	for name, iDiscovery := range d.discoveries {
+		named[name] = iDiscovery
+	}
+	return named, nil
 }
 
 // ParseServerMethod parse server and method
@@ -50,6 +50,9 @@ func Test_parseTarget(t *testing.T) {
 		"nacos://127.0.0.1:8848/dtmservice",
 		"nacos://foobar.com:8848/dtmservice?namespaceID=3454d2b5-2455",
 		"nacos://foobar.com:8848/dtmservice?namespaceID=3454d2b5-2455&username=your-username&password=your-password",
+
+		"etcd://[2001:db8::1]:2379/dtmservice",
+		"nacos://[::1]:8848/dtmservice",
 	}
 
 	for _, target := range targets {
@@ -75,6 +78,9 @@ func Test_parseEndpoint(t *testing.T) {
 
 		"http://127.0.0.1:36789",
 		"http://foobar.com:36789",
+
+		"grpc://[2001:db8::1]:36790",
+		"http://[fe80::1%25eth0]:36789",
 	}
 
 	for _, endpoint := range endpoints {
@@ -85,3 +91,29 @@ func Test_parseEndpoint(t *testing.T) {
 		t.Log(mark)
 	}
 }
+
+func Test_parseIPv6(t *testing.T) {
+	cfg, err := parseTarget("nacos://[2001:db8::1]:8848/dtmservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.nacos.host != "2001:db8::1" || cfg.nacos.port != 8848 {
+		t.Errorf("got nacos host %s port %d", cfg.nacos.host, cfg.nacos.port)
+	}
+
+	cfg, err = parseTarget("consul://[::1]:8500/dtmservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.consul.addr != "[::1]:8500" {
+		t.Errorf("got consul addr %s", cfg.consul.addr)
+	}
+
+	mark, err := parseEndpoint("grpc://[2001:db8::1]:36790")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != "grpc_2001-db8--1_36790" {
+		t.Errorf("got mark %s", mark)
+	}
+}
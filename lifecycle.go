@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// RegistrationPolicy is the action when the registry gives up registering dtm service again after the
+// registration is lost.
+type RegistrationPolicy int
+
+const (
+	// PolicyLog logs the give-up and dtm service stays unregistered, it is the default policy.
+	PolicyLog RegistrationPolicy = iota
+	// PolicyCrash exits the process, so that dtm is restarted by its supervisor and registered again.
+	PolicyCrash
+	// PolicyRetryForever keeps registering dtm service with backoff until it succeeds or dtm service is drained.
+	PolicyRetryForever
+)
+
+// exit the process with PolicyCrash, replaced in tests.
+var exit = os.Exit
+
+// newHooks logs the lifecycle events of the registration and records them as metrics, the give-up is handled
+// by the policy.
+func (d *SpongeDriver) newHooks(registryType string, policy RegistrationPolicy, r *registration) *registry.Hooks {
+	return &registry.Hooks{
+		OnRegistered: func(service *registry.ServiceInstance) {
+			d.metrics.RegistrationEvent(registryType, registry.EventRegistered)
+		},
+		OnLeaseLost: func(service *registry.ServiceInstance, err error) {
+			d.metrics.RegistrationEvent(registryType, registry.EventLeaseLost)
+			fmt.Printf("[driver] registration of %s in %s is lost: %v\n", service.ID, registryType, err)
+		},
+		OnReRegistered: func(service *registry.ServiceInstance) {
+			d.metrics.RegistrationEvent(registryType, registry.EventReRegistered)
+			fmt.Printf("[driver] %s is registered to %s again\n", service.ID, registryType)
+		},
+		OnGiveUp: func(service *registry.ServiceInstance, err error) {
+			d.metrics.RegistrationEvent(registryType, registry.EventGiveUp)
+			fmt.Printf("[driver] %s gives up registering %s: %v\n", registryType, service.ID, err)
+			switch policy {
+			case PolicyCrash:
+				fmt.Printf("[driver] exit because %s is not registered\n", service.ID)
+				exit(1)
+			case PolicyRetryForever:
+				go d.reregister(r, time.Second, time.Second*30)
+			}
+		},
+	}
+}
+
+// reregister registers the instance of the registration with backoff until it succeeds or the registration
+// is drained, the registration following the health of dtm service is registered again by its manager.
+func (d *SpongeDriver) reregister(r *registration, backoff time.Duration, maxBackoff time.Duration) {
+	for {
+		time.Sleep(backoff)
+		d.mu.Lock()
+		status, iRegistry, instance, manager := r.status, r.iRegistry, r.instance, r.manager
+		d.mu.Unlock()
+		if status != "" || iRegistry == nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		var err error
+		if manager != nil {
+			err = manager.Reregister(ctx)
+		} else {
+			err = iRegistry.Register(ctx, instance)
+		}
+		cancel()
+		if err == nil {
+			fmt.Printf("[driver] %s is registered to %s again\n", instance.ID, r.registryType)
+			return
+		}
+		fmt.Printf("[driver] register %s failed: %v\n", instance.ID, err)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
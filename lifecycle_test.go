@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// flakyRegistry fails the first failures registrations.
+type flakyRegistry struct {
+	mu            sync.Mutex
+	failures      int
+	registrations int
+}
+
+func (r *flakyRegistry) Register(context.Context, *registry.ServiceInstance) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registrations++
+	if r.registrations <= r.failures {
+		return errors.New("register failed")
+	}
+	return nil
+}
+
+func (r *flakyRegistry) Deregister(context.Context, *registry.ServiceInstance) error {
+	return nil
+}
+
+func (r *flakyRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.registrations
+}
+
+func TestSpongeDriver_newHooks(t *testing.T) {
+	defer func(old func(int)) { exit = old }(exit)
+	code := -1
+	exit = func(c int) { code = c }
+
+	d := new(SpongeDriver)
+	instance := registry.NewServiceInstance("dtmservice_grpc_127.0.0.1_36790", "dtmservice", []string{"grpc://127.0.0.1:36790"})
+	r := &registration{registryType: etcdType, instance: instance}
+
+	hooks := d.newHooks(etcdType, PolicyLog, r)
+	hooks.Registered(instance)
+	hooks.LeaseLost(instance, errors.New("keepalive channel closed"))
+	hooks.ReRegistered(instance)
+	hooks.GiveUp(instance, errors.New("register failed"))
+	if code != -1 {
+		t.Fatalf("exit with %d by PolicyLog", code)
+	}
+
+	d.newHooks(etcdType, PolicyCrash, r).GiveUp(instance, errors.New("register failed"))
+	if code != 1 {
+		t.Fatalf("got exit code %d, want 1", code)
+	}
+}
+
+func TestSpongeDriver_reregister(t *testing.T) {
+	d := new(SpongeDriver)
+	fr := &flakyRegistry{failures: 2}
+	r := &registration{
+		registryType: etcdType,
+		instance:     registry.NewServiceInstance("dtmservice_grpc_127.0.0.1_36790", "dtmservice", []string{"grpc://127.0.0.1:36790"}),
+		iRegistry:    fr,
+	}
+	d.addRegistration(r)
+
+	d.reregister(r, time.Millisecond, time.Millisecond*2)
+	if n := fr.count(); n != 3 {
+		t.Fatalf("registered %d times, want 3", n)
+	}
+
+	// drained registrations are not registered again
+	d.setStatus(r, "draining")
+	d.reregister(r, time.Millisecond, time.Millisecond)
+	if n := fr.count(); n != 3 {
+		t.Fatalf("registered %d times after draining, want 3", n)
+	}
+}
+
+func TestSpongeDriver_reregisterManager(t *testing.T) {
+	d := new(SpongeDriver)
+	fr := &flakyRegistry{}
+	instance := registry.NewServiceInstance("dtmservice_grpc_127.0.0.1_36790", "dtmservice", []string{"grpc://127.0.0.1:36790"})
+	manager := registry.NewManager(fr, instance, func(context.Context) bool { return true }, registry.WithHealthInterval(time.Hour))
+	if err := manager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r := &registration{registryType: etcdType, instance: instance, iRegistry: fr, manager: manager}
+	d.addRegistration(r)
+
+	// the instance is registered again by the manager
+	d.reregister(r, time.Millisecond, time.Millisecond)
+	if n := fr.count(); n != 2 {
+		t.Fatalf("registered %d times, want 2", n)
+	}
+	if !manager.Registered() {
+		t.Fatal("the manager does not know the instance is registered")
+	}
+
+	// stopped managers do not register the instance again
+	if err := manager.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	d.reregister(r, time.Millisecond, time.Millisecond)
+	if n := fr.count(); n != 2 {
+		t.Fatalf("registered %d times after stop, want 2", n)
+	}
+}
@@ -0,0 +1,162 @@
+package driver
+
+import (
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// Option set the driver options.
+type Option func(*options)
+
+type options struct {
+	registerer prometheus.Registerer
+	registries map[string]string // name -> target
+
+	advertiseHost  string
+	preferredCIDRs []*net.IPNet
+	hostMappings   map[string]string
+	portMappings   map[int]int
+
+	health     registry.HealthFunc
+	healthOpts []registry.ManagerOption
+
+	readinessProbe   ReadinessProbe
+	readinessTimeout time.Duration
+	readySignal      <-chan struct{}
+	registrationErrs chan<- error
+
+	drainPeriod time.Duration
+
+	serviceConfigInterval time.Duration
+
+	registrationPolicy RegistrationPolicy
+}
+
+func defaultOptions() *options {
+	return &options{
+		registries:   make(map[string]string),
+		hostMappings: make(map[string]string),
+		portMappings: make(map[int]int),
+		drainPeriod:  time.Second * 10,
+	}
+}
+
+func (o *options) apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithMetrics enable prometheus metrics of registration and discovery, the collectors are registered to reg.
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = reg
+	}
+}
+
+// WithRegistry adds a named registry, target has the same format as the target of dtm,
+// e.g. etcd://127.0.0.1:2379/dtmservice, the services in it are resolved with
+// discovery://<name>/your-service-name, while discovery:///your-service-name is resolved
+// from the registry of dtm.
+func WithRegistry(name string, target string) Option {
+	return func(o *options) {
+		o.registries[name] = target
+	}
+}
+
+// WithAdvertiseHost set the host registered when the host of dtm endpoint is unspecified or loopback,
+// e.g. grpc://0.0.0.0:36790, it takes precedence over the environment variables ADVERTISE_ADDR and POD_IP.
+func WithAdvertiseHost(host string) Option {
+	return func(o *options) {
+		o.advertiseHost = host
+	}
+}
+
+// WithPreferredCIDR set the CIDRs in which the interface address is registered when the host of dtm endpoint
+// is unspecified or loopback and no advertised address is set, invalid CIDRs are ignored.
+func WithPreferredCIDR(cidrs ...string) Option {
+	return func(o *options) {
+		for _, cidr := range cidrs {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+				o.preferredCIDRs = append(o.preferredCIDRs, ipNet)
+			}
+		}
+	}
+}
+
+// WithHostMapping registers the host from of dtm endpoint as to, e.g. the NAT address.
+func WithHostMapping(from string, to string) Option {
+	return func(o *options) {
+		o.hostMappings[from] = to
+	}
+}
+
+// WithPortMapping registers the port from of dtm endpoint as to, e.g. the port published by container.
+func WithPortMapping(from int, to int) Option {
+	return func(o *options) {
+		o.portMappings[from] = to
+	}
+}
+
+// WithHealthCheck registers dtm service only while health reports serving, the service is deregistered when
+// it becomes unhealthy and registered again on recovery, e.g. registry.FromHealthServer(healthServer, "").
+func WithHealthCheck(health registry.HealthFunc, opts ...registry.ManagerOption) Option {
+	return func(o *options) {
+		o.health = health
+		o.healthOpts = opts
+	}
+}
+
+// WithReadinessProbe registers dtm service only after the probe of its endpoint succeeds, the probe is retried
+// with backoff until timeout, 0 means 30s, e.g. TCPProbe() or GRPCHealthProbe(""). The registration is made
+// asynchronously, see WithRegistrationErrors.
+func WithReadinessProbe(probe ReadinessProbe, timeout time.Duration) Option {
+	return func(o *options) {
+		o.readinessProbe = probe
+		o.readinessTimeout = timeout
+	}
+}
+
+// WithReadySignal delays the registration of dtm service until ready is closed, the registration is made
+// asynchronously, and the readiness probe starts after the signal if it is set.
+func WithReadySignal(ready <-chan struct{}) Option {
+	return func(o *options) {
+		o.readySignal = ready
+	}
+}
+
+// WithRegistrationErrors sends the errors of the asynchronous registration made with WithReadinessProbe or
+// WithReadySignal to errs, the sending does not block, so errs should be buffered.
+func WithRegistrationErrors(errs chan<- error) Option {
+	return func(o *options) {
+		o.registrationErrs = errs
+	}
+}
+
+// WithDrainPeriod set the period between draining and deregistering dtm service in Drain, default 10s.
+func WithDrainPeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.drainPeriod = d
+	}
+}
+
+// WithServiceConfig loads the grpc service configs and traffic split rules of the resolved services from the
+// registry every interval, disabled by default.
+func WithServiceConfig(interval time.Duration) Option {
+	return func(o *options) {
+		o.serviceConfigInterval = interval
+	}
+}
+
+// WithRegistrationPolicy set the action when the registry gives up registering dtm service again after the
+// registration is lost, default PolicyLog. The lifecycle events of registrations are logged and recorded as
+// metrics regardless of the policy.
+func WithRegistrationPolicy(policy RegistrationPolicy) Option {
+	return func(o *options) {
+		o.registrationPolicy = policy
+	}
+}
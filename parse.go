@@ -1,17 +1,17 @@
 package driver
 
 import (
-	"context"
 	"fmt"
-	"net"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/consulcli"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/etcdcli"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/nacoscli"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/discovery"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/consul"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/etcd"
@@ -46,93 +46,107 @@ type driverConfig struct {
 	consul *consulConfig
 	etcd   *etcdConfig
 	nacos  *nacosConfig
+
+	metrics *metrics.Metrics
+	hooks   *registry.Hooks // hooks of the registration of dtm service
+
+	serviceConfigInterval time.Duration // 0 means the service configs are not loaded from the registry
 }
 
-// register dtm service to consul, etcd, nacos
-func (c *driverConfig) register(instanceEndpoint string, id string) error {
-	var (
-		err       error
-		iRegistry registry.Registry
-		instance  *registry.ServiceInstance
-	)
+// newRegistry creates registry of consul, etcd, nacos and the instance of dtm service
+func (c *driverConfig) newRegistry(instanceEndpoint string, id string) (registry.Registry, *registry.ServiceInstance, error) {
+	var iRegistry registry.Registry
+	instance := registry.NewServiceInstance(id, c.name, []string{instanceEndpoint})
+	if err := instance.Validate(); err != nil {
+		return nil, instance, err
+	}
 
 	switch c.Type {
 	case consulType:
-		iRegistry, instance, err = consul.NewRegistry(
-			c.consul.addr,
-			id,
-			c.name,
-			[]string{instanceEndpoint},
-			consulcli.WithToken(c.consul.token),
-		)
+		cli, err := consulcli.Init(c.consul.addr, consulcli.WithToken(c.consul.token))
 		if err != nil {
-			return err
+			return nil, instance, err
 		}
+		iRegistry = consul.New(cli, consul.WithHealthCheck(true), consul.WithMetrics(c.metrics), consul.WithHooks(c.hooks))
 
 	case etcdType:
-		iRegistry, instance, err = etcd.NewRegistry(
-			c.etcd.addrs,
-			id,
-			c.name,
-			[]string{instanceEndpoint},
-			etcdcli.WithAuth(c.etcd.username, c.etcd.password),
-		)
+		cli, err := etcdcli.Init(c.etcd.addrs, etcdcli.WithAuth(c.etcd.username, c.etcd.password))
 		if err != nil {
-			return err
+			return nil, instance, err
 		}
+		iRegistry = etcd.New(cli, etcd.WithMetrics(c.metrics), etcd.WithHooks(c.hooks))
 
 	case nacosType:
-		iRegistry, instance, err = nacos.NewRegistry(
+		cli, err := nacoscli.NewNamingClient(
 			c.nacos.host,
 			c.nacos.port,
 			c.nacos.namespaceID,
-			id,
-			c.name,
-			[]string{instanceEndpoint},
-			nacoscli.WithAuth(c.nacos.username, c.nacos.password),
-		)
-	}
-	if err != nil {
-		return err
+			nacoscli.WithAuth(c.nacos.username, c.nacos.password))
+		if err != nil {
+			return nil, instance, err
+		}
+		iRegistry = nacos.New(cli, nacos.WithMetrics(c.metrics), nacos.WithHooks(c.hooks))
+
+	default:
+		return nil, instance, fmt.Errorf("invalid registry type: %s", c.Type)
 	}
 
-	return iRegistry.Register(context.Background(), instance)
+	return iRegistry, instance, nil
 }
 
-// resolver discovery:///your-service-name from consul, etcd, nacos
-func (c *driverConfig) resolver() error {
-	var iDiscovery registry.Discovery
-
+// newDiscovery creates discovery of consul, etcd, nacos
+func (c *driverConfig) newDiscovery() (registry.Discovery, error) {
 	switch c.Type {
 	case consulType:
-		cli, err := consulcli.Init(c.consul.addr)
+		cli, err := consulcli.Init(c.consul.addr, consulcli.WithToken(c.consul.token))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		iDiscovery = consul.New(cli)
+		return consul.New(cli, consul.WithMetrics(c.metrics)), nil
 
 	case etcdType:
-		cli, err := etcdcli.Init(c.etcd.addrs)
+		cli, err := etcdcli.Init(c.etcd.addrs, etcdcli.WithAuth(c.etcd.username, c.etcd.password))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		iDiscovery = etcd.New(cli)
+		return etcd.New(cli, etcd.WithMetrics(c.metrics)), nil
 
 	case nacosType:
 		cli, err := nacoscli.NewNamingClient(
 			c.nacos.host,
 			c.nacos.port,
-			c.nacos.namespaceID)
+			c.nacos.namespaceID,
+			nacoscli.WithAuth(c.nacos.username, c.nacos.password))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		iDiscovery = nacos.New(cli)
+		return nacos.New(cli, nacos.WithMetrics(c.metrics)), nil
+	}
+
+	return nil, fmt.Errorf("invalid registry type: %s", c.Type)
+}
+
+// resolver discovery:///your-service-name from consul, etcd, nacos,
+// and discovery://<name>/your-service-name from the named registries.
+func (c *driverConfig) resolver(named map[string]registry.Discovery) error {
+	iDiscovery, err := c.newDiscovery()
+	if err != nil {
+		return err
 	}
 
-	builder := discovery.NewBuilder(iDiscovery,
+	opts := []discovery.Option{
+		// plaintext by default, TLS services are resolved with discovery:///your-service-name?secure=true
 		discovery.WithInsecure(true),
 		discovery.DisableDebugLog(),
-	)
+		discovery.WithMetrics(c.metrics),
+	}
+	if c.serviceConfigInterval > 0 {
+		opts = append(opts, discovery.WithServiceConfig(c.serviceConfigInterval))
+	}
+	for name, d := range named {
+		opts = append(opts, discovery.WithDiscovery(name, d))
+	}
+	builder := discovery.NewBuilder(iDiscovery, opts...)
 	// register a global resolver so that the dtmservice can resolve discovery:///your-service-name.
 	resolver.Register(builder)
 	return nil
@@ -171,7 +185,7 @@ func parseTarget(target string) (*driverConfig, error) {
 		if u.Host == "" {
 			return nil, fmt.Errorf("registry address is empty")
 		}
-		host = strings.ReplaceAll(u.Host, ":"+u.Port(), "")
+		host = u.Hostname() // without brackets of IPv6
 		addr = u.Host
 	}
 
@@ -212,17 +226,15 @@ func parseTarget(target string) (*driverConfig, error) {
 }
 
 func parseEndpoint(endpoint string) (string, error) {
-	u, err := url.Parse(endpoint)
+	e, err := registry.ParseEndpoint(endpoint)
 	if err != nil {
 		return "", err
 	}
-	if u.Scheme != "grpc" && u.Scheme != "http" {
-		return "", fmt.Errorf("invalid dtm service protocol: %s, only supports grpc, http, e.g. grpc://localhost:36790", u.Scheme)
-	}
-	host, port, err := net.SplitHostPort(u.Host)
-	if err != nil {
-		return "", err
+	if e.Scheme != "grpc" && e.Scheme != "http" {
+		return "", fmt.Errorf("invalid dtm service protocol: %s, only supports grpc, http, e.g. grpc://localhost:36790", e.Scheme)
 	}
+	// the colons of IPv6 and the percent of zone are not safe in registry keys and IDs
+	host := strings.NewReplacer(":", "-", "%", "-").Replace(e.Host)
 
-	return u.Scheme + "_" + host + "_" + port, nil
+	return e.Scheme + "_" + host + "_" + strconv.Itoa(e.Port), nil
 }
@@ -3,9 +3,13 @@ package discovery
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 
 	"google.golang.org/grpc/resolver"
@@ -37,17 +41,93 @@ func DisableDebugLog() Option {
 	}
 }
 
+// WithMetrics set prometheus metrics.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(b *builder) {
+		b.metrics = m
+	}
+}
+
+// WithHealthCheck probes the resolved instances every interval using the grpc.health.v1 protocol,
+// unhealthy instances are excluded from the resolved addresses until they recover. If all instances are
+// unhealthy, the addresses resolved last time are kept (fail open) and the error is shown in the debug state.
+// serviceName is the service name in the health check request, empty means the whole server.
+func WithHealthCheck(serviceName string, interval time.Duration, timeout time.Duration) Option {
+	return func(b *builder) {
+		b.healthCheck = &healthCheckConfig{
+			service:  serviceName,
+			interval: interval,
+			timeout:  timeout,
+		}
+	}
+}
+
+// WithOutlierDetector excludes the addresses ejected by the outlier detector from the resolved addresses,
+// the interceptors of d must be set in the dial options of client conns.
+func WithOutlierDetector(d *OutlierDetector) Option {
+	return func(b *builder) {
+		b.outlier = d
+	}
+}
+
+// WithDiscovery adds a named discovery, which resolves the target with the authority,
+// e.g. discovery://etcd-prod/your-service-name resolves your-service-name from the discovery named etcd-prod.
+func WithDiscovery(authority string, d registry.Discovery) Option {
+	return func(b *builder) {
+		b.discoverers[authority] = d
+	}
+}
+
+// WithWaitForInstances makes Build block until at least minInstances addresses are resolved or timeout passes,
+// if timeout passes, the error is reported to the client conn and the resolver keeps watching.
+func WithWaitForInstances(minInstances int, timeout time.Duration) Option {
+	return func(b *builder) {
+		b.waitMinInstances = minInstances
+		b.waitTimeout = timeout
+	}
+}
+
+// WithServiceConfig loads the grpc service config of the service from the registry if the discovery implements
+// registry.ConfigGetter, the service config is reloaded every interval in the background, and pushed to
+// the client conns with the addresses. The service config in use is kept if the registry fails.
+func WithServiceConfig(interval time.Duration) Option {
+	return func(b *builder) {
+		b.serviceConfigInterval = interval
+	}
+}
+
+// WithTrafficSplit splits the traffic of the service by instance version, e.g. v1:90,v2:10, a rule stored
+// in the registry with key traffic_split takes precedence if WithServiceConfig is set. The rule is applied to
+// the client conns of the service built by the builder, and can be changed at runtime with SetTrafficSplit.
+func WithTrafficSplit(serviceName string, rule string) Option {
+	return func(b *builder) {
+		b.trafficSplits[serviceName] = rule
+	}
+}
+
 type builder struct {
 	discoverer       registry.Discovery
+	discoverers      map[string]registry.Discovery
 	timeout          time.Duration
 	insecure         bool
 	debugLogDisabled bool
+	metrics          *metrics.Metrics
+	healthCheck      *healthCheckConfig
+	outlier          *OutlierDetector
+	waitMinInstances int
+	waitTimeout      time.Duration
+
+	serviceConfigInterval time.Duration
+	trafficSplits         map[string]string // service name -> rule
 }
 
-// NewBuilder creates a builder which is used to factory registry resolvers.
+// NewBuilder creates a builder which is used to factory registry resolvers,
+// d resolves the target without authority, e.g. discovery:///your-service-name.
 func NewBuilder(d registry.Discovery, opts ...Option) resolver.Builder {
 	b := &builder{
 		discoverer:       d,
+		discoverers:      make(map[string]registry.Discovery),
+		trafficSplits:    make(map[string]string),
 		timeout:          time.Second * 10,
 		insecure:         false,
 		debugLogDisabled: false,
@@ -58,38 +138,117 @@ func NewBuilder(d registry.Discovery, opts ...Option) resolver.Builder {
 	return b
 }
 
+// Build creates a resolver and returns immediately, the watcher of the service is created asynchronously,
+// errors of creating the watcher are reported to cc and the creation is retried until the resolver is closed.
 func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
-	var (
-		err error
-		w   registry.Watcher
-	)
-	done := make(chan struct{}, 1)
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		w, err = b.discoverer.Watch(ctx, strings.TrimPrefix(target.URL.Path, "/"))
-		close(done)
-	}()
-	select {
-	case <-done:
-	case <-time.After(b.timeout):
-		err = errors.New("discovery create watcher overtime")
+	d, err := b.getDiscovery(target.URL.Host)
+	if err != nil {
+		return nil, err
 	}
+	to, err := b.parseTargetOptions(target.URL.Query())
 	if err != nil {
-		cancel()
 		return nil, err
 	}
+	serviceName := strings.TrimPrefix(target.URL.Path, "/")
+	rule := b.trafficSplits[serviceName]
+	if rule != "" {
+		if _, err = ParseTrafficSplit(rule); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	r := &discoveryResolver{
-		w:                w,
+		d:                d,
 		cc:               cc,
+		serviceName:      serviceName,
+		target:           target.URL.String(),
 		ctx:              ctx,
 		cancel:           cancel,
-		insecure:         b.insecure,
+		timeout:          to.timeout,
+		insecure:         to.insecure,
+		scheme:           to.scheme,
 		debugLogDisabled: b.debugLogDisabled,
+		metrics:          b.metrics,
+		minInstances:     b.waitMinInstances,
+		ready:            make(chan struct{}),
+
+		defaultTrafficSplit: rule,
+		trafficSplit:        rule,
+	}
+	if b.healthCheck != nil {
+		r.health = newHealthChecker(*b.healthCheck, to.insecure, func() { r.push(time.Now()) })
+		go r.health.run(ctx)
+	}
+	if b.outlier != nil {
+		r.outlier = b.outlier
+		r.watchOutlier()
+	}
+	if cg, ok := d.(registry.ConfigGetter); ok && b.serviceConfigInterval > 0 {
+		r.configGetter = cg
+		go r.watchConfig(b.serviceConfigInterval)
+	}
+	addActiveResolver(r)
+	go r.run()
+
+	if b.waitMinInstances > 0 {
+		select {
+		case <-r.ready:
+		case <-time.After(b.waitTimeout):
+			r.reportError(fmt.Errorf("wait for %d instances of %s overtime", b.waitMinInstances, r.serviceName))
+		}
 	}
-	go r.watch()
 	return r, nil
 }
 
+// targetOptions are the options of a target, which override the options of builder.
+type targetOptions struct {
+	insecure bool
+	timeout  time.Duration
+	scheme   string // scheme of the endpoints to be resolved
+}
+
+// parseTargetOptions parses the options in query of the target,
+// e.g. discovery:///your-service-name?secure=true&timeout=3s&scheme=grpc
+func (b *builder) parseTargetOptions(query url.Values) (*targetOptions, error) {
+	to := &targetOptions{
+		insecure: b.insecure,
+		timeout:  b.timeout,
+		scheme:   "grpc",
+	}
+	if v := query.Get("secure"); v != "" {
+		secure, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("discovery: invalid secure %q in target", v)
+		}
+		to.insecure = !secure
+	}
+	if v := query.Get("timeout"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("discovery: invalid timeout %q in target", v)
+		}
+		to.timeout = timeout
+	}
+	if v := query.Get("scheme"); v != "" {
+		to.scheme = v
+	}
+	return to, nil
+}
+
+func (b *builder) getDiscovery(authority string) (registry.Discovery, error) {
+	if authority == "" {
+		if b.discoverer == nil {
+			return nil, errors.New("discovery: no default discovery, the target must have an authority")
+		}
+		return b.discoverer, nil
+	}
+	d, ok := b.discoverers[authority]
+	if !ok {
+		return nil, fmt.Errorf("discovery: unknown registry %q", authority)
+	}
+	return d, nil
+}
+
 // Scheme return scheme of discovery
 func (*builder) Scheme() string {
 	return name
@@ -44,3 +44,65 @@ func TestBuilder(t *testing.T) {
 	_, err := b.Build(resolver.Target{URL: u}, nil, resolver.BuildOptions{})
 	t.Log(err)
 }
+
+type namedDiscovery struct {
+	discovery
+	watched chan string
+}
+
+func (d *namedDiscovery) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	d.watched <- serviceName
+	return &watcher{}, nil
+}
+
+func TestBuilder_WithDiscovery(t *testing.T) {
+	prod := &namedDiscovery{watched: make(chan string, 1)}
+	b := NewBuilder(&discovery{},
+		WithDiscovery("etcd-prod", prod),
+		DisableDebugLog(),
+	)
+
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: "discovery", Host: "etcd-prod", Path: "/order-svc"}},
+		&cliConn{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if name := <-prod.watched; name != "order-svc" {
+		t.Errorf("got service name %s, want order-svc", name)
+	}
+
+	_, err = b.Build(resolver.Target{URL: url.URL{Scheme: "discovery", Host: "nacos-legacy", Path: "/pay-svc"}},
+		&cliConn{}, resolver.BuildOptions{})
+	if err == nil {
+		t.Error("expect error of unknown registry")
+	}
+}
+
+func TestBuilder_parseTargetOptions(t *testing.T) {
+	b := NewBuilder(&discovery{}, WithInsecure(true), WithTimeout(time.Second)).(*builder)
+
+	to, err := b.parseTargetOptions(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !to.insecure || to.timeout != time.Second || to.scheme != "grpc" {
+		t.Errorf("unexpected default options: %+v", to)
+	}
+
+	u, _ := url.Parse("discovery:///foo?secure=true&timeout=3s&scheme=http")
+	to, err = b.parseTargetOptions(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.insecure || to.timeout != 3*time.Second || to.scheme != "http" {
+		t.Errorf("unexpected options: %+v", to)
+	}
+
+	for _, query := range []string{"secure=foo", "timeout=3", "timeout=-1s"} {
+		u, _ = url.Parse("discovery:///foo?" + query)
+		if _, err = b.parseTargetOptions(u.Query()); err == nil {
+			t.Errorf("expect error of %s", query)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// loadConfig gets the service configurations from the registry, it returns true if any of them changed.
+// The configurations in use are kept if the registry fails or the new ones are invalid.
+func (r *discoveryResolver) loadConfig() bool {
+	ctx, cancel := context.WithTimeout(r.ctx, time.Second*3)
+	defer cancel()
+	tsChanged, tsErr := r.loadTrafficSplit(ctx)
+	scChanged, scErr := r.loadServiceConfig(ctx)
+	if r.ctx.Err() == nil {
+		r.setConfigError(errors.Join(tsErr, scErr))
+	}
+	return scChanged || tsChanged
+}
+
+// setConfigError logs the error of loading configurations once until it changes.
+func (r *discoveryResolver) setConfigError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.configErr = ""
+		return
+	}
+	if err.Error() == r.configErr {
+		return
+	}
+	r.configErr = err.Error()
+	fmt.Printf("[resolver] %v, the configurations in use are kept\n", err)
+	r.lastErr, r.lastErrorAt = err, time.Now()
+}
+
+func (r *discoveryResolver) loadServiceConfig(ctx context.Context) (bool, error) {
+	raw, err := r.configGetter.GetConfig(ctx, r.serviceName, registry.ConfigKeyServiceConfig)
+	if err != nil {
+		return false, fmt.Errorf("get service config of %s error: %v", r.serviceName, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if raw == r.rawServiceConfig {
+		return false, nil
+	}
+	var sc *serviceconfig.ParseResult
+	if raw != "" && r.cc != nil {
+		sc = r.cc.ParseServiceConfig(raw)
+		if sc.Err != nil {
+			return false, fmt.Errorf("invalid service config of %s: %v", r.serviceName, sc.Err)
+		}
+	}
+	r.rawServiceConfig = raw
+	r.serviceConfig = sc
+	return true, nil
+}
+
+// loadTrafficSplit gets the traffic split rule from the registry, the rule in registry takes precedence
+// over the rule of builder option, it returns true if the rule changed.
+func (r *discoveryResolver) loadTrafficSplit(ctx context.Context) (bool, error) {
+	rule, err := r.configGetter.GetConfig(ctx, r.serviceName, registry.ConfigKeyTrafficSplit)
+	if err != nil {
+		return false, fmt.Errorf("get traffic split of %s error: %v", r.serviceName, err)
+	}
+	if rule == "" {
+		rule = r.defaultTrafficSplit
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the rule set by SetTrafficSplit is kept until the rule in registry changes
+	if rule == r.loadedTrafficSplit {
+		return false, nil
+	}
+	if rule != "" {
+		if _, err = ParseTrafficSplit(rule); err != nil {
+			return false, fmt.Errorf("invalid traffic split of %s: %v", r.serviceName, err)
+		}
+	}
+	r.loadedTrafficSplit = rule
+	if rule == r.trafficSplit {
+		return false, nil
+	}
+	r.trafficSplit = rule
+	return true, nil
+}
+
+// watchConfig loads the service configurations at once and every interval, and pushes the state if they
+// changed, the configurations are loaded in the background so that the updates of addresses are not delayed.
+func (r *discoveryResolver) watchConfig(interval time.Duration) {
+	if r.loadConfig() {
+		r.push(time.Now())
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if r.loadConfig() {
+				r.push(time.Now())
+			}
+		}
+	}
+}
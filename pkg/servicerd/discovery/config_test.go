@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc/resolver"
+)
+
+type configDiscovery struct {
+	chanDiscovery
+	mu     sync.Mutex
+	config string
+	err    error
+	gets   int
+}
+
+func (d *configDiscovery) GetConfig(ctx context.Context, serviceName string, key string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gets++
+	if d.err != nil {
+		return "", d.err
+	}
+	if key != registry.ConfigKeyServiceConfig {
+		return "", nil
+	}
+	return d.config, nil
+}
+
+func (d *configDiscovery) setConfig(config string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config = config
+}
+
+func (d *configDiscovery) setError(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+}
+
+func (d *configDiscovery) getCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.gets
+}
+
+func (c *stateConn) hasServiceConfig() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.ServiceConfig != nil
+}
+
+func TestBuilder_WithServiceConfig(t *testing.T) {
+	d := &configDiscovery{chanDiscovery: chanDiscovery{ch: make(chan []*registry.ServiceInstance)}}
+	b := NewBuilder(d, WithServiceConfig(time.Millisecond*20), WithInsecure(true), DisableDebugLog())
+	cc := &stateConn{}
+	r, err := b.Build(resolver.Target{URL: url.URL{Path: "/foo"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	d.ch <- []*registry.ServiceInstance{registry.NewServiceInstance("a", "foo", []string{"grpc://127.0.0.1:8281"})}
+	time.Sleep(time.Millisecond * 50)
+	if cc.hasServiceConfig() {
+		t.Error("unexpected service config")
+	}
+
+	d.setConfig(`{"methodConfig":[{"name":[{"service":"foo"}],"timeout":"3s"}]}`)
+	deadline := time.Now().Add(time.Second)
+	for !cc.hasServiceConfig() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !cc.hasServiceConfig() {
+		t.Error("service config is not pushed")
+	}
+}
+
+type configConn struct {
+	stateConn
+	errs atomic.Int32
+}
+
+func (c *configConn) ReportError(error) {
+	c.errs.Add(1)
+}
+
+func TestBuilder_WithServiceConfigError(t *testing.T) {
+	d := &configDiscovery{chanDiscovery: chanDiscovery{ch: make(chan []*registry.ServiceInstance)}}
+	d.setConfig(`{"methodConfig":[{"name":[{"service":"foo"}],"timeout":"3s"}]}`)
+	b := NewBuilder(d, WithServiceConfig(time.Millisecond*20), WithInsecure(true), DisableDebugLog())
+	cc := &configConn{}
+	r, err := b.Build(resolver.Target{URL: url.URL{Path: "/foo"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	d.ch <- []*registry.ServiceInstance{registry.NewServiceInstance("a", "foo", []string{"grpc://127.0.0.1:8281"})}
+	deadline := time.Now().Add(time.Second)
+	for !cc.hasServiceConfig() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !cc.hasServiceConfig() {
+		t.Fatal("service config is not pushed")
+	}
+
+	// the failures of registry are recorded once, the service config in use is kept
+	d.setError(errors.New("connection refused"))
+	dr := r.(*discoveryResolver)
+	var lastErrorAt time.Time
+	deadline = time.Now().Add(time.Second)
+	for lastErrorAt.IsZero() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+		dr.mu.Lock()
+		lastErrorAt = dr.lastErrorAt
+		dr.mu.Unlock()
+	}
+	if lastErrorAt.IsZero() {
+		t.Fatal("error of loading config is not recorded")
+	}
+	// wait for more failed loads
+	gets := d.getCount()
+	for d.getCount() < gets+4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	dr.mu.Lock()
+	again := dr.lastErrorAt
+	dr.mu.Unlock()
+	if !again.Equal(lastErrorAt) {
+		t.Error("error of loading config is recorded again")
+	}
+	if n := cc.errs.Load(); n != 0 {
+		t.Errorf("got %d resolver errors, want none", n)
+	}
+	if !cc.hasServiceConfig() {
+		t.Error("service config is not kept")
+	}
+}
+
+func TestBuilder_WithServiceConfigUpdate(t *testing.T) {
+	d := &configDiscovery{chanDiscovery: chanDiscovery{ch: make(chan []*registry.ServiceInstance)}}
+	b := NewBuilder(d, WithServiceConfig(time.Hour), WithInsecure(true), DisableDebugLog())
+	cc := &stateConn{}
+	r, err := b.Build(resolver.Target{URL: url.URL{Path: "/foo"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// the config is loaded at once, not with the updates of addresses
+	for i := 0; i < 3; i++ {
+		d.ch <- []*registry.ServiceInstance{registry.NewServiceInstance("a", "foo", []string{"grpc://127.0.0.1:8281"})}
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := d.getCount(); n != 2 {
+		t.Errorf("got %d config requests, want 2", n)
+	}
+}
@@ -0,0 +1,182 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+type healthCheckConfig struct {
+	service  string // service name in grpc.health.v1.HealthCheckRequest, empty means the whole server
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// healthChecker probes the resolved addresses with the grpc.health.v1 protocol,
+// an address is healthy until a probe of it fails.
+type healthChecker struct {
+	cfg      healthCheckConfig
+	dialOpts []grpc.DialOption
+	onChange func()
+
+	mu        sync.Mutex
+	conns     map[string]*grpc.ClientConn
+	unhealthy map[string]struct{}
+	closed    bool
+
+	checkMu sync.Mutex
+}
+
+func newHealthChecker(cfg healthCheckConfig, isInsecure bool, onChange func()) *healthChecker {
+	cred := insecure.NewCredentials()
+	if !isInsecure {
+		cred = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	return &healthChecker{
+		cfg:       cfg,
+		dialOpts:  []grpc.DialOption{grpc.WithTransportCredentials(cred)},
+		onChange:  onChange,
+		conns:     make(map[string]*grpc.ClientConn),
+		unhealthy: make(map[string]struct{}),
+	}
+}
+
+// run probes the addresses periodically until ctx is done.
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check(ctx)
+		}
+	}
+}
+
+// setAddrs replaces the addresses to be probed, new addresses are probed immediately.
+func (h *healthChecker) setAddrs(ctx context.Context, addrs []string) {
+	h.mu.Lock()
+	if h.closed {
+		// no more probes after the resolver is closed
+		h.mu.Unlock()
+		return
+	}
+	keep := make(map[string]struct{}, len(addrs))
+	added := false
+	for _, addr := range addrs {
+		keep[addr] = struct{}{}
+		if _, ok := h.conns[addr]; ok {
+			continue
+		}
+		conn, err := grpc.Dial(addr, h.dialOpts...)
+		if err != nil {
+			continue
+		}
+		h.conns[addr] = conn
+		added = true
+	}
+	for addr, conn := range h.conns {
+		if _, ok := keep[addr]; !ok {
+			_ = conn.Close()
+			delete(h.conns, addr)
+			delete(h.unhealthy, addr)
+		}
+	}
+	h.mu.Unlock()
+
+	if added {
+		go h.check(ctx)
+	}
+}
+
+func (h *healthChecker) isHealthy(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.unhealthy[addr]
+	return !ok
+}
+
+// check probes all addresses concurrently and calls onChange if any address changes its health.
+func (h *healthChecker) check(ctx context.Context) {
+	h.checkMu.Lock()
+	defer h.checkMu.Unlock()
+
+	h.mu.Lock()
+	conns := make(map[string]*grpc.ClientConn, len(h.conns))
+	for addr, conn := range h.conns {
+		conns[addr] = conn
+	}
+	h.mu.Unlock()
+
+	results := make(map[string]bool, len(conns))
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for addr, conn := range conns {
+		wg.Add(1)
+		go func(addr string, conn *grpc.ClientConn) {
+			defer wg.Done()
+			ok := h.probe(ctx, conn)
+			mu.Lock()
+			results[addr] = ok
+			mu.Unlock()
+		}(addr, conn)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	changed := false
+	h.mu.Lock()
+	for addr, ok := range results {
+		if _, exist := h.conns[addr]; !exist {
+			continue // removed during probing
+		}
+		_, wasUnhealthy := h.unhealthy[addr]
+		if ok && wasUnhealthy {
+			delete(h.unhealthy, addr)
+			changed = true
+		} else if !ok && !wasUnhealthy {
+			h.unhealthy[addr] = struct{}{}
+			changed = true
+		}
+	}
+	h.mu.Unlock()
+
+	if changed && h.onChange != nil {
+		h.onChange()
+	}
+}
+
+func (h *healthChecker) probe(ctx context.Context, conn *grpc.ClientConn) bool {
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.timeout)
+	defer cancel()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: h.cfg.service})
+	if err != nil {
+		// the server does not support health checking, regard it as healthy
+		return status.Code(err) == codes.Unimplemented
+	}
+	return resp.GetStatus() == grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+func (h *healthChecker) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for addr, conn := range h.conns {
+		_ = conn.Close()
+		delete(h.conns, addr)
+	}
+}
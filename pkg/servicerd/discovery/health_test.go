@@ -0,0 +1,166 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+)
+
+type stateConn struct {
+	cliConn
+	mu    sync.Mutex
+	state resolver.State
+}
+
+func (c *stateConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	return nil
+}
+
+func (c *stateConn) addrs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var addrs []string
+	for _, addr := range c.state.Addresses {
+		addrs = append(addrs, addr.Addr)
+	}
+	return addrs
+}
+
+func newHealthServer(t *testing.T) (string, *health.Server) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+	return lis.Addr().String(), hs
+}
+
+func waitAddrs(t *testing.T, cc *stateConn, want int) {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(cc.addrs()) == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("got addrs %v, want %d addrs", cc.addrs(), want)
+}
+
+func TestHealthCheck(t *testing.T) {
+	addr1, hs1 := newHealthServer(t)
+	addr2, _ := newHealthServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := &stateConn{}
+	r := &discoveryResolver{
+		w:                &watcher{},
+		cc:               cc,
+		ctx:              ctx,
+		cancel:           cancel,
+		insecure:         true,
+		debugLogDisabled: true,
+	}
+	r.health = newHealthChecker(healthCheckConfig{interval: 50 * time.Millisecond, timeout: time.Second},
+		true, func() { r.push(time.Now()) })
+	go r.health.run(ctx)
+	defer r.Close()
+
+	r.update([]*registry.ServiceInstance{
+		registry.NewServiceInstance("1", "foo", []string{"grpc://" + addr1}),
+		registry.NewServiceInstance("2", "foo", []string{"grpc://" + addr2}),
+	})
+	waitAddrs(t, cc, 2)
+
+	hs1.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	waitAddrs(t, cc, 1)
+	if addrs := cc.addrs(); addrs[0] != addr2 {
+		t.Errorf("got addr %s, want %s", addrs[0], addr2)
+	}
+
+	hs1.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	waitAddrs(t, cc, 2)
+}
+
+func TestHealthCheck_allUnhealthy(t *testing.T) {
+	addr1, hs1 := newHealthServer(t)
+	addr2, hs2 := newHealthServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := &stateConn{}
+	r := &discoveryResolver{
+		w:                &watcher{},
+		cc:               cc,
+		ctx:              ctx,
+		cancel:           cancel,
+		insecure:         true,
+		debugLogDisabled: true,
+	}
+	r.health = newHealthChecker(healthCheckConfig{interval: 50 * time.Millisecond, timeout: time.Second},
+		true, func() { r.push(time.Now()) })
+	go r.health.run(ctx)
+	defer r.Close()
+
+	r.update([]*registry.ServiceInstance{
+		registry.NewServiceInstance("1", "foo", []string{"grpc://" + addr1}),
+		registry.NewServiceInstance("2", "foo", []string{"grpc://" + addr2}),
+	})
+	waitAddrs(t, cc, 2)
+	hs1.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	waitAddrs(t, cc, 1)
+
+	// the addresses pushed last time are kept if all addresses are unhealthy
+	hs2.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	deadline := time.Now().Add(5 * time.Second)
+	for r.health.isHealthy(addr2) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not marked unhealthy", addr2)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if addrs := cc.addrs(); len(addrs) != 1 || addrs[0] != addr2 {
+		t.Fatalf("got addrs %v, want [%s]", addrs, addr2)
+	}
+	r.mu.Lock()
+	pushed, lastErr := len(r.pushed), r.lastErr
+	r.mu.Unlock()
+	if pushed != 1 || lastErr == nil {
+		t.Fatalf("got %d pushed addrs and error %v, want 1 addr and an error", pushed, lastErr)
+	}
+
+	hs1.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	for addrs := cc.addrs(); len(addrs) != 1 || addrs[0] != addr1; addrs = cc.addrs() {
+		if time.Now().After(deadline) {
+			t.Fatalf("got addrs %v, want [%s]", addrs, addr1)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHealthCheck_setAddrsAfterClose(t *testing.T) {
+	addr, _ := newHealthServer(t)
+	h := newHealthChecker(healthCheckConfig{interval: time.Second, timeout: time.Second}, true, nil)
+	h.close()
+	h.setAddrs(context.Background(), []string{addr})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.conns) != 0 {
+		t.Fatalf("got %d conns after close, want 0", len(h.conns))
+	}
+}
@@ -0,0 +1,318 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// OutlierOption set the outlier detector options.
+type OutlierOption func(*outlierOptions)
+
+type outlierOptions struct {
+	interval           time.Duration
+	minRequests        int
+	errorRate          float64
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+	codes              map[codes.Code]struct{}
+}
+
+func defaultOutlierOptions() *outlierOptions {
+	return &outlierOptions{
+		interval:           time.Second * 10,
+		minRequests:        5,
+		errorRate:          0.5,
+		baseEjectionTime:   time.Second * 30,
+		maxEjectionTime:    time.Minute * 5,
+		maxEjectionPercent: 50,
+		codes:              map[codes.Code]struct{}{codes.Unavailable: {}},
+	}
+}
+
+func (o *outlierOptions) apply(opts ...OutlierOption) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithOutlierInterval set the interval of error rate evaluation, default 10s.
+func WithOutlierInterval(interval time.Duration) OutlierOption {
+	return func(o *outlierOptions) {
+		o.interval = interval
+	}
+}
+
+// WithOutlierMinRequests set the minimum number of requests of an address in an interval
+// to be evaluated, default 5.
+func WithOutlierMinRequests(n int) OutlierOption {
+	return func(o *outlierOptions) {
+		o.minRequests = n
+	}
+}
+
+// WithOutlierErrorRate set the error rate in (0, 1] from which an address is ejected, default 0.5.
+func WithOutlierErrorRate(rate float64) OutlierOption {
+	return func(o *outlierOptions) {
+		o.errorRate = rate
+	}
+}
+
+// WithOutlierEjectionTime set the ejection time, an address is ejected for base*2^(n-1) at
+// its nth consecutive ejection, up to max. default base 30s, max 5m.
+func WithOutlierEjectionTime(base time.Duration, max time.Duration) OutlierOption {
+	return func(o *outlierOptions) {
+		o.baseEjectionTime = base
+		o.maxEjectionTime = max
+	}
+}
+
+// WithOutlierMaxEjectionPercent set the maximum percent of addresses of a resolver that can be ejected, default 50.
+func WithOutlierMaxEjectionPercent(percent int) OutlierOption {
+	return func(o *outlierOptions) {
+		o.maxEjectionPercent = percent
+	}
+}
+
+// WithOutlierErrorCodes set the grpc codes regarded as errors, default codes.Unavailable.
+func WithOutlierErrorCodes(cs ...codes.Code) OutlierOption {
+	return func(o *outlierOptions) {
+		o.codes = make(map[codes.Code]struct{}, len(cs))
+		for _, c := range cs {
+			o.codes[c] = struct{}{}
+		}
+	}
+}
+
+type hostStats struct {
+	requests     int
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// OutlierDetector tracks the error rate of each address through the client interceptors and
+// ejects the outliers temporarily from the addresses of the resolvers built with WithOutlierDetector.
+type OutlierDetector struct {
+	opts *outlierOptions
+
+	mu        sync.Mutex
+	hosts     map[string]*hostStats
+	listeners map[int]func()
+	hostFuncs map[int]func() // called when a call to a new address is recorded
+	nextID    int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewOutlierDetector creates an outlier detector, call Close to stop it.
+func NewOutlierDetector(opts ...OutlierOption) *OutlierDetector {
+	o := defaultOutlierOptions()
+	o.apply(opts...)
+
+	d := &OutlierDetector{
+		opts:      o,
+		hosts:     make(map[string]*hostStats),
+		listeners: make(map[int]func()),
+		hostFuncs: make(map[int]func()),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	go d.run()
+	return d
+}
+
+// UnaryClientInterceptor records the result of unary calls.
+func (d *OutlierDetector) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		p := &peer.Peer{}
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Peer(p))...)
+		d.record(p, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor records the result of streams.
+func (d *OutlierDetector) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		p := &peer.Peer{}
+		cs, err := streamer(ctx, desc, cc, method, append(opts, grpc.Peer(p))...)
+		if err != nil {
+			d.record(p, err)
+			return nil, err
+		}
+		return &outlierStream{ClientStream: cs, d: d, p: p}, nil
+	}
+}
+
+type outlierStream struct {
+	grpc.ClientStream
+	d    *OutlierDetector
+	p    *peer.Peer
+	once sync.Once
+}
+
+func (s *outlierStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			if err == io.EOF {
+				s.d.record(s.p, nil)
+			} else {
+				s.d.record(s.p, err)
+			}
+		})
+	}
+	return err
+}
+
+func (d *OutlierDetector) record(p *peer.Peer, err error) {
+	if p.Addr == nil {
+		return // no address was picked
+	}
+	addr := p.Addr.String()
+	failed := false
+	if err != nil {
+		_, failed = d.opts.codes[status.Code(err)]
+	}
+
+	var hostFuncs []func()
+	d.mu.Lock()
+	hs, ok := d.hosts[addr]
+	if !ok {
+		hs = &hostStats{}
+		d.hosts[addr] = hs
+		for _, fn := range d.hostFuncs {
+			hostFuncs = append(hostFuncs, fn)
+		}
+	}
+	hs.requests++
+	if failed {
+		hs.failures++
+	}
+	d.mu.Unlock()
+
+	for _, fn := range hostFuncs {
+		fn()
+	}
+}
+
+// isEjected reports whether the address is ejected now.
+func (d *OutlierDetector) isEjected(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hs, ok := d.hosts[addr]
+	return ok && time.Now().Before(hs.ejectedUntil)
+}
+
+// subscribe adds a function called when any address is ejected or returned, it returns the unsubscribe function.
+func (d *OutlierDetector) subscribe(fn func()) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.nextID
+	d.nextID++
+	d.listeners[id] = fn
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.listeners, id)
+	}
+}
+
+// subscribeHosts adds a function called when a call to a new address is recorded, the function must not block,
+// it returns the unsubscribe function.
+func (d *OutlierDetector) subscribeHosts(fn func()) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.nextID
+	d.nextID++
+	d.hostFuncs[id] = fn
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.hostFuncs, id)
+	}
+}
+
+func (d *OutlierDetector) run() {
+	ticker := time.NewTicker(d.opts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.evaluate(time.Now())
+		}
+	}
+}
+
+// evaluate ejects the addresses whose error rate exceeds the threshold and returns
+// the addresses whose ejection time is over.
+func (d *OutlierDetector) evaluate(now time.Time) {
+	changed := false
+	d.mu.Lock()
+	for addr, hs := range d.hosts {
+		ejected := !hs.ejectedUntil.IsZero()
+		switch {
+		case ejected && !now.Before(hs.ejectedUntil):
+			hs.ejectedUntil = time.Time{}
+			changed = true
+		case ejected:
+		case hs.requests >= d.opts.minRequests && hs.requests > 0 &&
+			float64(hs.failures)/float64(hs.requests) >= d.opts.errorRate:
+			hs.ejections++
+			hs.ejectedUntil = now.Add(d.ejectionTime(hs.ejections))
+			changed = true
+		case hs.requests == 0 && hs.ejections == 0:
+			delete(d.hosts, addr) // no traffic anymore
+		case hs.ejections > 0 && hs.failures == 0:
+			hs.ejections--
+		}
+		hs.requests, hs.failures = 0, 0
+	}
+	listeners := make([]func(), 0, len(d.listeners))
+	for _, fn := range d.listeners {
+		listeners = append(listeners, fn)
+	}
+	d.mu.Unlock()
+
+	if changed {
+		for _, fn := range listeners {
+			fn()
+		}
+	}
+}
+
+func (d *OutlierDetector) ejectionTime(ejections int) time.Duration {
+	t := d.opts.baseEjectionTime
+	for i := 1; i < ejections; i++ {
+		t *= 2
+		if t >= d.opts.maxEjectionTime {
+			return d.opts.maxEjectionTime
+		}
+	}
+	if t > d.opts.maxEjectionTime {
+		return d.opts.maxEjectionTime
+	}
+	return t
+}
+
+// maxEjected returns the maximum number of ejected addresses out of total.
+func (d *OutlierDetector) maxEjected(total int) int {
+	return total * d.opts.maxEjectionPercent / 100
+}
+
+// Close stops the outlier detector.
+func (d *OutlierDetector) Close() {
+	d.cancel()
+}
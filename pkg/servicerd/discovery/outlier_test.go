@@ -0,0 +1,151 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+func fakeInvoker(addr string, err error) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		for _, opt := range opts {
+			if p, ok := opt.(grpc.PeerCallOption); ok {
+				p.PeerAddr.Addr, _ = net.ResolveTCPAddr("tcp", addr)
+			}
+		}
+		return err
+	}
+}
+
+func TestOutlierDetector(t *testing.T) {
+	d := NewOutlierDetector(
+		WithOutlierInterval(time.Hour),
+		WithOutlierMinRequests(2),
+		WithOutlierErrorRate(0.5),
+		WithOutlierEjectionTime(time.Second, time.Second*3),
+		WithOutlierMaxEjectionPercent(50),
+		WithOutlierErrorCodes(codes.Unavailable),
+	)
+	defer d.Close()
+
+	changed := 0
+	unsubscribe := d.subscribe(func() { changed++ })
+	defer unsubscribe()
+
+	interceptor := d.UnaryClientInterceptor()
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	for i := 0; i < 3; i++ {
+		_ = interceptor(context.Background(), "/foo", nil, nil, nil, fakeInvoker("127.0.0.1:8281", unavailable))
+		_ = interceptor(context.Background(), "/foo", nil, nil, nil, fakeInvoker("127.0.0.1:8282", nil))
+		_ = interceptor(context.Background(), "/foo", nil, nil, nil, fakeInvoker("127.0.0.1:8283", unavailable))
+	}
+
+	now := time.Now()
+	d.evaluate(now)
+	if changed != 1 {
+		t.Errorf("changed = %d, want 1", changed)
+	}
+	if !d.isEjected("127.0.0.1:8281") || d.isEjected("127.0.0.1:8282") {
+		t.Error("wrong ejected addresses")
+	}
+
+	// at most half of addresses are ejected
+	r := &discoveryResolver{outlier: d}
+	addrs := r.excludeOutliers([]resolver.Address{
+		{Addr: "127.0.0.1:8281"}, {Addr: "127.0.0.1:8282"}, {Addr: "127.0.0.1:8283"},
+	})
+	if len(addrs) != 2 {
+		t.Errorf("got %d addresses, want 2", len(addrs))
+	}
+
+	// return after the ejection time
+	d.evaluate(now.Add(time.Second * 2))
+	if d.isEjected("127.0.0.1:8281") {
+		t.Error("127.0.0.1:8281 should be returned")
+	}
+	if changed != 2 {
+		t.Errorf("changed = %d, want 2", changed)
+	}
+}
+
+func TestOutlierDetector_ejectionTime(t *testing.T) {
+	d := NewOutlierDetector(WithOutlierEjectionTime(time.Second, time.Second*5))
+	defer d.Close()
+
+	want := []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5}
+	for i, w := range want {
+		if got := d.ejectionTime(i + 1); got != w {
+			t.Errorf("ejectionTime(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestOutlierDetector_hostName(t *testing.T) {
+	d := NewOutlierDetector(
+		WithOutlierInterval(time.Hour),
+		WithOutlierMinRequests(2),
+		WithOutlierMaxEjectionPercent(50),
+	)
+	defer d.Close()
+
+	// the results are recorded by the dialled ip:port of localhost:8281
+	interceptor := d.UnaryClientInterceptor()
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	for i := 0; i < 3; i++ {
+		_ = interceptor(context.Background(), "/foo", nil, nil, nil, fakeInvoker("127.0.0.1:8281", unavailable))
+	}
+	d.evaluate(time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := &stateConn{}
+	r := &discoveryResolver{
+		cc:               cc,
+		ctx:              ctx,
+		cancel:           cancel,
+		insecure:         true,
+		debugLogDisabled: true,
+		outlier:          d,
+	}
+	r.watchOutlier()
+	defer r.Close()
+	r.update([]*registry.ServiceInstance{
+		registry.NewServiceInstance("1", "foo", []string{"grpc://localhost:8281"}),
+		registry.NewServiceInstance("2", "foo", []string{"grpc://127.0.0.1:8282"}),
+	})
+	// the host names are resolved in the background, the state is pushed again after that
+	deadline := time.Now().Add(3 * time.Second)
+	for addrs := cc.addrs(); len(addrs) != 1 || addrs[0] != "127.0.0.1:8282"; addrs = cc.addrs() {
+		if time.Now().After(deadline) {
+			t.Fatalf("got addrs %v, want 127.0.0.1:8282", addrs)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestOutlierDetector_subscribeHosts(t *testing.T) {
+	d := NewOutlierDetector(WithOutlierInterval(time.Hour))
+	defer d.Close()
+	n := 0
+	unsubscribe := d.subscribeHosts(func() { n++ })
+
+	interceptor := d.UnaryClientInterceptor()
+	for _, addr := range []string{"127.0.0.1:8281", "127.0.0.1:8281", "127.0.0.1:8282"} {
+		_ = interceptor(context.Background(), "/foo", nil, nil, nil, fakeInvoker(addr, nil))
+	}
+	if n != 2 {
+		t.Errorf("got %d calls, want 2 calls for the new addresses", n)
+	}
+	unsubscribe()
+	_ = interceptor(context.Background(), "/foo", nil, nil, nil, fakeInvoker("127.0.0.1:8283", nil))
+	if n != 2 {
+		t.Errorf("got %d calls after unsubscribe, want 2", n)
+	}
+}
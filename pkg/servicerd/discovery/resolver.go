@@ -6,25 +6,129 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
 )
 
 type discoveryResolver struct {
-	w  registry.Watcher
-	cc resolver.ClientConn
+	d           registry.Discovery
+	w           registry.Watcher
+	cc          resolver.ClientConn
+	serviceName string
+	target      string
 
-	ctx    context.Context
-	cancel context.CancelFunc
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration // timeout of creating watcher
 
 	insecure         bool
+	scheme           string
 	debugLogDisabled bool
+	metrics          *metrics.Metrics
+	health           *healthChecker
+	outlier          *OutlierDetector
+	unsubscribe      func()
+	lookup           chan struct{} // signals the host names of addresses to be resolved, nil means no outlier detector
+	minInstances     int           // ready is closed when the number of addresses reaches minInstances
+	ready            chan struct{} // nil means no waiting
+	readyOnce        sync.Once
+	configGetter     registry.ConfigGetter // nil means the service config is not loaded from registry
+
+	mu          sync.Mutex
+	closed      bool
+	addrs       []resolver.Address  // all addresses of the latest instances
+	outlierKeys map[string][]string // address -> dialled ip:port of host name address, keys of outlier stats
+	pushed      []resolver.Address  // addresses in the latest state of client conn
+	allDraining bool                // all instances are draining, the empty state is pushed
+	lastUpdate  time.Time
+	lastErr     error
+	lastErrorAt time.Time
+
+	rawServiceConfig    string
+	serviceConfig       *serviceconfig.ParseResult
+	configErr           string // the logged error of loading configurations, the error is logged once
+	defaultTrafficSplit string // rule of builder option
+	trafficSplit        string // rule in use
+	loadedTrafficSplit  string // rule loaded from registry, or the rule of builder option if none
+}
+
+// run creates the watcher and watches the service.
+func (r *discoveryResolver) run() {
+	if !r.createWatcher() {
+		return
+	}
+	r.watch()
+}
+
+// createWatcher creates the watcher with retries, it returns false if the resolver is closed.
+func (r *discoveryResolver) createWatcher() bool {
+	backoff := time.Second
+	for {
+		type result struct {
+			w   registry.Watcher
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			w, err := r.d.Watch(r.ctx, r.serviceName)
+			done <- result{w, err}
+		}()
+
+		var res result
+		select {
+		case res = <-done:
+		case <-time.After(r.timeout):
+			err := fmt.Errorf("discovery create watcher of %s overtime", r.serviceName)
+			r.reportError(err)
+			res = <-done // wait for the slow registry, the watcher is stopped if the resolver has been closed
+		}
+
+		if res.err == nil {
+			r.mu.Lock()
+			closed := r.closed
+			if !closed {
+				r.w = res.w
+			}
+			r.mu.Unlock()
+			if closed {
+				_ = res.w.Stop()
+				return false
+			}
+			return true
+		}
+
+		if r.ctx.Err() != nil {
+			return false
+		}
+		r.reportError(fmt.Errorf("discovery create watcher of %s error: %v", r.serviceName, res.err))
+		select {
+		case <-r.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff < time.Second*30 {
+			backoff *= 2
+		}
+	}
+}
+
+func (r *discoveryResolver) reportError(err error) {
+	fmt.Printf("[resolver] %v\n", err)
+	r.setError(err)
+	if r.cc != nil {
+		r.cc.ReportError(err)
+	}
 }
 
 func (r *discoveryResolver) watch() {
@@ -40,6 +144,7 @@ func (r *discoveryResolver) watch() {
 				return
 			}
 			fmt.Printf("[resolver] Failed to watch discovery endpoint: %v\n", err)
+			r.setError(err)
 			time.Sleep(time.Second)
 			continue
 		}
@@ -47,11 +152,23 @@ func (r *discoveryResolver) watch() {
 	}
 }
 
+// update pushes the addresses of the instances, no instances are ignored, but an empty state is pushed
+// if all instances are draining, so that they receive no more traffic.
 func (r *discoveryResolver) update(ins []*registry.ServiceInstance) {
+	start := time.Now()
+	scheme := r.scheme
+	if scheme == "" {
+		scheme = "grpc"
+	}
 	addrs := make([]resolver.Address, 0)
 	endpoints := make(map[string]struct{})
+	draining := 0
 	for _, in := range ins {
-		endpoint, err := parseEndpoint(in.Endpoints, "grpc", !r.insecure)
+		if in.Metadata[registry.MetadataKeyStatus] == registry.StatusDraining {
+			draining++
+			continue
+		}
+		endpoint, err := parseEndpoint(in.Endpoints, scheme, !r.insecure)
 		if err != nil {
 			//fmt.Printf("[resolver] Failed to parse discovery endpoint: %v\n", err)
 			continue
@@ -72,14 +189,24 @@ func (r *discoveryResolver) update(ins []*registry.ServiceInstance) {
 		addr.Attributes = addr.Attributes.WithValue("rawServiceInstance", in)
 		addrs = append(addrs, addr)
 	}
-	if len(addrs) == 0 {
+	if len(addrs) == 0 && draining == 0 {
 		//fmt.Printf("[resolver] Zero endpoint found,refused to write, instances: %v\n", ins)
 		return
 	}
-	err := r.cc.UpdateState(resolver.State{Addresses: addrs})
-	if err != nil {
-		fmt.Printf("[resolver] failed to update state: %v\n", err)
+
+	r.mu.Lock()
+	r.addrs = addrs
+	r.allDraining = len(addrs) == 0
+	r.mu.Unlock()
+	r.refreshOutlierKeys()
+	if r.health != nil {
+		hostAddrs := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			hostAddrs = append(hostAddrs, addr.Addr)
+		}
+		r.health.setAddrs(r.ctx, hostAddrs)
 	}
+	r.push(start)
 
 	if !r.debugLogDisabled {
 		b, _ := json.Marshal(ins)
@@ -87,9 +214,216 @@ func (r *discoveryResolver) update(ins []*registry.ServiceInstance) {
 	}
 }
 
+// push updates the state of client conn with the available addresses.
+func (r *discoveryResolver) push(start time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	addrs := make([]resolver.Address, 0, len(r.addrs))
+	for _, addr := range r.addrs {
+		if r.health != nil && !r.health.isHealthy(addr.Addr) {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if r.outlier != nil {
+		addrs = r.excludeOutliers(addrs)
+	}
+	if len(addrs) == 0 && !r.allDraining {
+		// fail open: the client conn keeps the addresses pushed last time if all of them are unhealthy or ejected
+		if len(r.addrs) > 0 {
+			r.lastErr, r.lastErrorAt = fmt.Errorf("all %d addresses of %s are unhealthy, the addresses pushed last time are kept",
+				len(r.addrs), r.serviceName), time.Now()
+		}
+		return
+	}
+
+	state := resolver.State{Addresses: addrs}
+	if r.serviceConfig != nil {
+		state.ServiceConfig = r.serviceConfig
+	} else if r.trafficSplit != "" && r.cc != nil {
+		// select the version weighted balancer if the registry does not deliver the service config
+		state.ServiceConfig = r.cc.ParseServiceConfig(versionWeightedServiceConfig)
+	}
+	if r.trafficSplit != "" {
+		state = withTrafficSplit(state, r.trafficSplit)
+	}
+	err := r.cc.UpdateState(state)
+	if err != nil {
+		fmt.Printf("[resolver] failed to update state: %v\n", err)
+		r.lastErr, r.lastErrorAt = err, time.Now()
+	}
+	r.pushed = addrs
+	r.lastUpdate = time.Now()
+	if r.ready != nil && len(addrs) >= r.minInstances {
+		r.readyOnce.Do(func() { close(r.ready) })
+	}
+	r.metrics.ResolverUpdate(r.serviceName, start)
+	r.metrics.Instances(r.serviceName, len(addrs))
+}
+
+// excludeOutliers removes the ejected addresses, no more than the max ejection percent of addresses are removed.
+func (r *discoveryResolver) excludeOutliers(addrs []resolver.Address) []resolver.Address {
+	limit := r.outlier.maxEjected(len(addrs))
+	result := make([]resolver.Address, 0, len(addrs))
+	for _, addr := range addrs {
+		if limit > 0 && r.isOutlier(addr.Addr) {
+			limit--
+			continue
+		}
+		result = append(result, addr)
+	}
+	return result
+}
+
+// isOutlier reports whether the address is ejected, the address of host name is ejected if any of
+// its dialled ip:port is ejected.
+func (r *discoveryResolver) isOutlier(addr string) bool {
+	if r.outlier.isEjected(addr) {
+		return true
+	}
+	for _, key := range r.outlierKeys[addr] {
+		if r.outlier.isEjected(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchOutlier pushes the state when any address is ejected or returned, and resolves the host names of
+// addresses in the background after the addresses change or a call to a new ip:port is recorded.
+func (r *discoveryResolver) watchOutlier() {
+	r.lookup = make(chan struct{}, 1)
+	unsubscribe := r.outlier.subscribe(func() { r.push(time.Now()) })
+	unsubscribeHosts := r.outlier.subscribeHosts(r.refreshOutlierKeys)
+	r.unsubscribe = func() {
+		unsubscribe()
+		unsubscribeHosts()
+	}
+	go r.resolveOutlierKeys()
+}
+
+// refreshOutlierKeys signals the host names of addresses to be resolved again, it does not block.
+func (r *discoveryResolver) refreshOutlierKeys() {
+	if r.lookup == nil {
+		return
+	}
+	select {
+	case r.lookup <- struct{}{}:
+	default:
+	}
+}
+
+// resolveOutlierKeys resolves the host names of addresses when signalled, and pushes the state if the dialled
+// ip:port of any address changes. The lookup errors are logged once until they change.
+func (r *discoveryResolver) resolveOutlierKeys() {
+	logged := make(map[string]string) // host -> logged lookup error
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.lookup:
+		}
+		r.mu.Lock()
+		addrs, prev := r.addrs, r.outlierKeys
+		r.mu.Unlock()
+
+		keys := lookupOutlierKeys(r.ctx, addrs, prev, logged)
+		if r.ctx.Err() != nil {
+			return
+		}
+		r.mu.Lock()
+		changed := !equalOutlierKeys(keys, r.outlierKeys)
+		r.outlierKeys = keys
+		r.mu.Unlock()
+		if changed {
+			r.push(time.Now())
+		}
+	}
+}
+
+type hostLookup struct {
+	addr string
+	host string
+	port string
+	ips  []string
+	err  error
+}
+
+// lookupOutlierKeys resolves the host names of addresses concurrently, the results of calls are recorded by the
+// dialled ip:port in outlier detector. The previous keys of an address are kept if the lookup fails.
+func lookupOutlierKeys(ctx context.Context, addrs []resolver.Address, prev map[string][]string, logged map[string]string) map[string][]string {
+	lookups := make([]hostLookup, 0, len(addrs))
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr.Addr)
+		if err != nil || net.ParseIP(host) != nil {
+			continue
+		}
+		lookups = append(lookups, hostLookup{addr: addr.Addr, host: host, port: port})
+	}
+	var wg sync.WaitGroup
+	for i := range lookups {
+		wg.Add(1)
+		go func(l *hostLookup) {
+			defer wg.Done()
+			lookupCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			l.ips, l.err = net.DefaultResolver.LookupHost(lookupCtx, l.host)
+		}(&lookups[i])
+	}
+	wg.Wait()
+
+	keys := make(map[string][]string)
+	for _, l := range lookups {
+		if l.err != nil {
+			if logged[l.host] != l.err.Error() && ctx.Err() == nil {
+				logged[l.host] = l.err.Error()
+				fmt.Printf("[resolver] lookup %s error: %v\n", l.host, l.err)
+			}
+			if ks, ok := prev[l.addr]; ok {
+				keys[l.addr] = ks
+			}
+			continue
+		}
+		delete(logged, l.host)
+		for _, ip := range l.ips {
+			keys[l.addr] = append(keys[l.addr], net.JoinHostPort(ip, l.port))
+		}
+	}
+	return keys
+}
+
+func equalOutlierKeys(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for addr, ks := range a {
+		if strings.Join(ks, ",") != strings.Join(b[addr], ",") {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *discoveryResolver) Close() {
+	removeActiveResolver(r)
 	r.cancel()
-	err := r.w.Stop()
+
+	r.mu.Lock()
+	r.closed = true
+	w := r.w
+	r.mu.Unlock()
+
+	if r.unsubscribe != nil {
+		r.unsubscribe()
+	}
+	if r.health != nil {
+		r.health.close()
+	}
+	if w == nil {
+		return // the watcher is stopped after created
+	}
+	err := w.Stop()
 	if err != nil {
 		fmt.Printf("[resolver] failed to watch top: %v\n", err)
 	}
@@ -109,21 +443,28 @@ func parseAttributes(md map[string]string) *attributes.Attributes {
 	return a
 }
 
-// parseEndpoint parses an Endpoint URL.
+// parseEndpoint returns the address of the first endpoint which matches the scheme and isSecure,
+// invalid endpoints are skipped.
 func parseEndpoint(endpoints []string, scheme string, isSecure bool) (string, error) {
-	for _, e := range endpoints {
-		u, err := url.Parse(e)
+	var firstErr error
+	for _, endpoint := range endpoints {
+		e, err := registry.ParseEndpoint(endpoint)
 		if err != nil {
-			return "", err
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
-		if u.Scheme == scheme && IsSecure(u) == isSecure {
-			return u.Host, nil
+		if e.Scheme == scheme && e.IsSecure == isSecure {
+			return e.Address(), nil
 		}
 	}
-	return "", nil
+	return "", firstErr
 }
 
 // IsSecure parses isSecure for Endpoint URL.
+//
+// Deprecated: use registry.ParseEndpoint.
 func IsSecure(u *url.URL) bool {
 	ok, err := strconv.ParseBool(u.Query().Get("isSecure"))
 	if err != nil {
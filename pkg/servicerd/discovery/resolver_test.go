@@ -2,6 +2,7 @@ package discovery
 
 import (
 	"context"
+	"net/url"
 	"testing"
 	"time"
 
@@ -50,3 +51,131 @@ func Test_discoveryResolver(t *testing.T) {
 	r.watch()
 	time.Sleep(time.Second)
 }
+
+type slowDiscovery struct {
+	discovery
+	release chan struct{}
+	w       *stopWatcher
+}
+
+func (d *slowDiscovery) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	<-d.release
+	return d.w, nil
+}
+
+type stopWatcher struct {
+	watcher
+	stopped chan struct{}
+}
+
+func (w *stopWatcher) Stop() error {
+	close(w.stopped)
+	return nil
+}
+
+type errConn struct {
+	cliConn
+	errs chan error
+}
+
+func (c *errConn) ReportError(err error) {
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
+
+func TestBuilder_lateWatcher(t *testing.T) {
+	d := &slowDiscovery{
+		release: make(chan struct{}),
+		w:       &stopWatcher{stopped: make(chan struct{})},
+	}
+	b := NewBuilder(d, WithTimeout(time.Millisecond*10), DisableDebugLog())
+	cc := &errConn{errs: make(chan error, 1)}
+
+	r, err := b.Build(resolver.Target{URL: url.URL{Path: "/foo"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cc.errs:
+	case <-time.After(time.Second):
+		t.Error("timeout error is not reported")
+	}
+
+	r.Close()
+	close(d.release)
+	select {
+	case <-d.w.stopped:
+	case <-time.After(time.Second):
+		t.Error("the watcher created after closed is not stopped")
+	}
+}
+
+func Test_parseEndpointIPv6(t *testing.T) {
+	endpoint, err := parseEndpoint([]string{"http://[::1]:8080", "grpc://[2001:db8::1]:8282"}, "grpc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != "[2001:db8::1]:8282" {
+		t.Errorf("got endpoint %s", endpoint)
+	}
+}
+
+func Test_discoveryResolverDraining(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := &stateConn{}
+	r := &discoveryResolver{
+		cc:               cc,
+		ctx:              ctx,
+		cancel:           cancel,
+		insecure:         true,
+		debugLogDisabled: true,
+		ready:            make(chan struct{}),
+	}
+	defer r.Close()
+
+	in1 := registry.NewServiceInstance("1", "foo", []string{"grpc://127.0.0.1:8281"})
+	in2 := registry.NewServiceInstance("2", "foo", []string{"grpc://127.0.0.1:8282"})
+	r.update([]*registry.ServiceInstance{in1, in2})
+	if len(cc.addrs()) != 2 {
+		t.Fatalf("got addrs %v, want 2 addrs", cc.addrs())
+	}
+
+	r.update([]*registry.ServiceInstance{in1, registry.Draining(in2)})
+	if addrs := cc.addrs(); len(addrs) != 1 || addrs[0] != "127.0.0.1:8281" {
+		t.Fatalf("got addrs %v, want 127.0.0.1:8281", addrs)
+	}
+}
+
+func Test_discoveryResolverDrainingAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := &stateConn{}
+	r := &discoveryResolver{
+		cc:               cc,
+		ctx:              ctx,
+		cancel:           cancel,
+		insecure:         true,
+		debugLogDisabled: true,
+	}
+	defer r.Close()
+
+	in := registry.NewServiceInstance("1", "foo", []string{"grpc://127.0.0.1:8281"})
+	r.update([]*registry.ServiceInstance{in})
+	if len(cc.addrs()) != 1 {
+		t.Fatalf("got addrs %v, want 1 addr", cc.addrs())
+	}
+
+	// the only instance is draining
+	r.update([]*registry.ServiceInstance{registry.Draining(in)})
+	if addrs := cc.addrs(); len(addrs) != 0 {
+		t.Fatalf("got addrs %v after draining the only instance, want none", addrs)
+	}
+
+	// no instances are ignored
+	r.update([]*registry.ServiceInstance{in})
+	r.update(nil)
+	if len(cc.addrs()) != 1 {
+		t.Fatalf("got addrs %v after no instances, want 1 addr", cc.addrs())
+	}
+}
@@ -0,0 +1,103 @@
+package discovery
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// ResolverState is the state of an active resolver.
+type ResolverState struct {
+	ServiceName string         `json:"serviceName"`
+	Target      string         `json:"target"`
+	Addresses   []AddressState `json:"addresses"`
+	LastUpdate  time.Time      `json:"lastUpdate"`
+	LastError   string         `json:"lastError,omitempty"`
+	LastErrorAt time.Time      `json:"lastErrorAt"`
+}
+
+// AddressState is an address resolved from an instance.
+type AddressState struct {
+	Addr       string            `json:"addr"`
+	InstanceID string            `json:"instanceID"`
+	Version    string            `json:"version,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+var (
+	activeResolvers   = make(map[*discoveryResolver]struct{})
+	activeResolversMu sync.Mutex
+)
+
+func addActiveResolver(r *discoveryResolver) {
+	activeResolversMu.Lock()
+	defer activeResolversMu.Unlock()
+	activeResolvers[r] = struct{}{}
+}
+
+func removeActiveResolver(r *discoveryResolver) {
+	activeResolversMu.Lock()
+	defer activeResolversMu.Unlock()
+	delete(activeResolvers, r)
+}
+
+func getActiveResolvers() []*discoveryResolver {
+	activeResolversMu.Lock()
+	defer activeResolversMu.Unlock()
+	rs := make([]*discoveryResolver, 0, len(activeResolvers))
+	for r := range activeResolvers {
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// Resolvers returns the states of all active resolvers, sorted by service name.
+func Resolvers() []ResolverState {
+	rs := getActiveResolvers()
+	states := make([]ResolverState, 0, len(rs))
+	for _, r := range rs {
+		states = append(states, r.state())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].ServiceName == states[j].ServiceName {
+			return states[i].Target < states[j].Target
+		}
+		return states[i].ServiceName < states[j].ServiceName
+	})
+	return states
+}
+
+func (r *discoveryResolver) state() ResolverState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := ResolverState{
+		ServiceName: r.serviceName,
+		Target:      r.target,
+		Addresses:   make([]AddressState, 0, len(r.pushed)),
+		LastUpdate:  r.lastUpdate,
+		LastErrorAt: r.lastErrorAt,
+	}
+	if r.lastErr != nil {
+		s.LastError = r.lastErr.Error()
+	}
+	for _, addr := range r.pushed {
+		as := AddressState{Addr: addr.Addr}
+		if in, ok := addr.Attributes.Value("rawServiceInstance").(*registry.ServiceInstance); ok {
+			as.InstanceID = in.ID
+			as.Version = in.Version
+			as.Metadata = in.Metadata
+		}
+		s.Addresses = append(s.Addresses, as)
+	}
+	return s
+}
+
+func (r *discoveryResolver) setError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastErr = err
+	r.lastErrorAt = time.Now()
+}
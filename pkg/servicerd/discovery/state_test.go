@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+func TestResolvers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &discoveryResolver{
+		w:                &watcher{},
+		cc:               &cliConn{},
+		serviceName:      "foo",
+		target:           "discovery:///foo",
+		ctx:              ctx,
+		cancel:           cancel,
+		insecure:         true,
+		debugLogDisabled: true,
+	}
+	addActiveResolver(r)
+	r.update([]*registry.ServiceInstance{registry.NewServiceInstance("1", "foo", []string{"grpc://127.0.0.1:8282"},
+		registry.WithMetadata(map[string]string{"foo": "bar"}))})
+
+	s, ok := findResolver(r.target)
+	if !ok {
+		t.Fatal("resolver not found")
+	}
+	if s.ServiceName != "foo" || len(s.Addresses) != 1 || s.Addresses[0].InstanceID != "1" {
+		t.Errorf("unexpected state: %+v", s)
+	}
+
+	r.Close()
+	if _, ok = findResolver(r.target); ok {
+		t.Error("resolver is not removed after closed")
+	}
+}
+
+func findResolver(target string) (ResolverState, bool) {
+	for _, s := range Resolvers() {
+		if s.Target == target {
+			return s, true
+		}
+	}
+	return ResolverState{}, false
+}
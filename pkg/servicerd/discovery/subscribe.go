@@ -0,0 +1,153 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// EventType is the type of service instance change.
+type EventType int
+
+const (
+	// EventAdded a new instance is found.
+	EventAdded EventType = iota + 1
+	// EventRemoved an instance is gone.
+	EventRemoved
+	// EventUpdated an instance with the same ID has changed.
+	EventUpdated
+)
+
+// String returns the name of event type.
+func (t EventType) String() string {
+	switch t {
+	case EventAdded:
+		return "added"
+	case EventRemoved:
+		return "removed"
+	case EventUpdated:
+		return "updated"
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// Event is a service instance change.
+type Event struct {
+	Type     EventType
+	Instance *registry.ServiceInstance
+	// Previous is the instance before changed, only set when Type is EventUpdated.
+	Previous *registry.ServiceInstance
+}
+
+// Handler handles the events found between two snapshots of instances,
+// it is called sequentially in the goroutine of subscription.
+type Handler func(events []Event)
+
+// Subscription is a subscription of service instance changes.
+type Subscription struct {
+	w      registry.Watcher
+	cancel context.CancelFunc
+}
+
+// Subscribe watches the service and calls handler with the instances added, removed and updated
+// since the previous snapshot, instances are keyed by ID. It returns after the watcher is created,
+// the subscription ends when ctx is done or Stop is called.
+func Subscribe(ctx context.Context, d registry.Discovery, serviceName string, handler Handler) (*Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	w, err := d.Watch(ctx, serviceName)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s := &Subscription{w: w, cancel: cancel}
+	go s.run(ctx, handler)
+	return s, nil
+}
+
+func (s *Subscription) run(ctx context.Context, handler Handler) {
+	var prev []*registry.ServiceInstance
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		ins, err := s.w.Next()
+		if err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("[subscribe] failed to watch discovery endpoint: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		events := Diff(prev, ins)
+		prev = ins
+		if len(events) > 0 {
+			handler(events)
+		}
+	}
+}
+
+// Stop cancels the subscription and stops the watcher.
+func (s *Subscription) Stop() error {
+	s.cancel()
+	return s.w.Stop()
+}
+
+// Diff returns the events that change the instances from prev to cur, instances are keyed by ID.
+func Diff(prev, cur []*registry.ServiceInstance) []Event {
+	prevMap := make(map[string]*registry.ServiceInstance, len(prev))
+	for _, in := range prev {
+		prevMap[in.ID] = in
+	}
+	curMap := make(map[string]*registry.ServiceInstance, len(cur))
+
+	var events []Event
+	for _, in := range cur {
+		if _, ok := curMap[in.ID]; ok {
+			continue
+		}
+		curMap[in.ID] = in
+		old, ok := prevMap[in.ID]
+		if !ok {
+			events = append(events, Event{Type: EventAdded, Instance: in})
+			continue
+		}
+		if !instanceEqual(old, in) {
+			events = append(events, Event{Type: EventUpdated, Instance: in, Previous: old})
+		}
+	}
+	for _, in := range prev {
+		if _, ok := curMap[in.ID]; ok {
+			continue
+		}
+		curMap[in.ID] = in // prevent duplicate IDs in prev from being removed twice
+		events = append(events, Event{Type: EventRemoved, Instance: in})
+	}
+	return events
+}
+
+func instanceEqual(a, b *registry.ServiceInstance) bool {
+	if a.Name != b.Name || a.Version != b.Version {
+		return false
+	}
+	if len(a.Endpoints) != len(b.Endpoints) || len(a.Metadata) != len(b.Metadata) {
+		return false
+	}
+	for i := range a.Endpoints {
+		if a.Endpoints[i] != b.Endpoints[i] {
+			return false
+		}
+	}
+	for k, v := range a.Metadata {
+		if bv, ok := b.Metadata[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+type chanDiscovery struct {
+	ch chan []*registry.ServiceInstance
+}
+
+func (d *chanDiscovery) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	return nil, nil
+}
+
+func (d *chanDiscovery) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	return &chanWatcher{ctx: ctx, ch: d.ch}, nil
+}
+
+type chanWatcher struct {
+	ctx context.Context
+	ch  chan []*registry.ServiceInstance
+}
+
+func (w *chanWatcher) Next() ([]*registry.ServiceInstance, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	case ins := <-w.ch:
+		return ins, nil
+	}
+}
+
+func (w *chanWatcher) Stop() error {
+	return nil
+}
+
+func TestDiff(t *testing.T) {
+	a := registry.NewServiceInstance("a", "foo", []string{"grpc://127.0.0.1:8281"})
+	b := registry.NewServiceInstance("b", "foo", []string{"grpc://127.0.0.1:8282"})
+	b2 := registry.NewServiceInstance("b", "foo", []string{"grpc://127.0.0.1:8282"},
+		registry.WithMetadata(map[string]string{"weight": "10"}))
+	c := registry.NewServiceInstance("c", "foo", []string{"grpc://127.0.0.1:8283"})
+
+	events := Diff([]*registry.ServiceInstance{a, b}, []*registry.ServiceInstance{b2, c})
+	want := []EventType{EventUpdated, EventAdded, EventRemoved}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		if e.Type != want[i] {
+			t.Errorf("events[%d].Type = %s, want %s", i, e.Type, want[i])
+		}
+	}
+	if events[0].Previous != b {
+		t.Error("previous instance of the updated event is wrong")
+	}
+
+	events = Diff([]*registry.ServiceInstance{a, b}, []*registry.ServiceInstance{a, b})
+	if len(events) != 0 {
+		t.Errorf("got %d events, want 0", len(events))
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	d := &chanDiscovery{ch: make(chan []*registry.ServiceInstance)}
+	got := make(chan []Event, 2)
+	s, err := Subscribe(context.Background(), d, "foo", func(events []Event) {
+		got <- events
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	a := registry.NewServiceInstance("a", "foo", []string{"grpc://127.0.0.1:8281"})
+	d.ch <- []*registry.ServiceInstance{a}
+	d.ch <- []*registry.ServiceInstance{}
+
+	for _, want := range []EventType{EventAdded, EventRemoved} {
+		select {
+		case events := <-got:
+			if len(events) != 1 || events[0].Type != want {
+				t.Errorf("got %v, want one %s event", events, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for events")
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package discovery
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// VersionWeightedBalancerName is the name of the balancer which splits traffic by instance version.
+const VersionWeightedBalancerName = "version_weighted"
+
+// the service config which selects the version weighted balancer
+const versionWeightedServiceConfig = `{"loadBalancingConfig":[{"` + VersionWeightedBalancerName + `":{}}]}`
+
+func init() {
+	balancer.Register(versionBalancerBuilder{})
+}
+
+// TrafficSplit is the percent of traffic of each version.
+type TrafficSplit map[string]int
+
+// ParseTrafficSplit parses the traffic split rule, e.g. v1:90,v2:10
+func ParseTrafficSplit(rule string) (TrafficSplit, error) {
+	ts := TrafficSplit{}
+	for _, part := range strings.Split(rule, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.LastIndexByte(part, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid traffic split %q, e.g. v1:90,v2:10", rule)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight of traffic split %q", part)
+		}
+		ts[strings.TrimSpace(part[:i])] = weight
+	}
+	if len(ts) == 0 {
+		return nil, fmt.Errorf("empty traffic split %q", rule)
+	}
+	return ts, nil
+}
+
+// String returns the rule of traffic split.
+func (ts TrafficSplit) String() string {
+	versions := make([]string, 0, len(ts))
+	for v := range ts {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	parts := make([]string, 0, len(versions))
+	for _, v := range versions {
+		parts = append(parts, v+":"+strconv.Itoa(ts[v]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// SetTrafficSplit sets the traffic split rule of the active resolvers of the service in the process, it takes
+// effect after the resolvers push the state, an empty rule restores the rule of builder option. The rule is
+// replaced by the rule in registry when it changes if WithServiceConfig is set.
+func SetTrafficSplit(serviceName string, rule string) error {
+	if rule != "" {
+		if _, err := ParseTrafficSplit(rule); err != nil {
+			return err
+		}
+	}
+	for _, r := range getActiveResolvers() {
+		if r.serviceName != serviceName {
+			continue
+		}
+		r.mu.Lock()
+		r.trafficSplit = rule
+		if rule == "" {
+			r.trafficSplit = r.defaultTrafficSplit
+		}
+		r.mu.Unlock()
+		r.push(time.Now())
+	}
+	return nil
+}
+
+// trafficSplitKey is the key of the traffic split rule in the attributes of resolver state.
+type trafficSplitKey struct{}
+
+// withTrafficSplit sets the traffic split rule in the attributes of resolver state, the rule is passed to the
+// balancer of the client conn.
+func withTrafficSplit(state resolver.State, rule string) resolver.State {
+	state.Attributes = state.Attributes.WithValue(trafficSplitKey{}, rule)
+	return state
+}
+
+// trafficSplitFromState returns the traffic split rule in the attributes of resolver state, nil if none.
+func trafficSplitFromState(state resolver.State) TrafficSplit {
+	rule, _ := state.Attributes.Value(trafficSplitKey{}).(string)
+	if rule == "" {
+		return nil
+	}
+	ts, err := ParseTrafficSplit(rule)
+	if err != nil {
+		return nil
+	}
+	return ts
+}
+
+type versionBalancerBuilder struct{}
+
+func (versionBalancerBuilder) Name() string {
+	return VersionWeightedBalancerName
+}
+
+// Build creates a round robin balancer of the ready sub conns by version, the traffic split rule of
+// the client conn is passed with the resolver state.
+func (versionBalancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &versionPickerBuilder{}
+	b := base.NewBalancerBuilder(VersionWeightedBalancerName, pb, base.Config{HealthCheck: true}).Build(cc, opts)
+	return &versionBalancer{Balancer: b, pb: pb}
+}
+
+type versionBalancer struct {
+	balancer.Balancer
+	pb *versionPickerBuilder
+}
+
+func (b *versionBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.pb.trafficSplit.Store(trafficSplitFromState(s.ResolverState))
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+func (b *versionBalancer) ExitIdle() {
+	if ei, ok := b.Balancer.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
+
+// versionPickerBuilder builds the pickers of a client conn, which pick by the latest traffic split rule.
+type versionPickerBuilder struct {
+	trafficSplit atomic.Value // TrafficSplit
+}
+
+func (b *versionPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &versionPicker{groups: make(map[string]*scGroup), trafficSplit: &b.trafficSplit}
+	for sc, sci := range info.ReadySCs {
+		version := ""
+		if in, ok := sci.Address.Attributes.Value("rawServiceInstance").(*registry.ServiceInstance); ok {
+			version = in.Version
+		}
+		g, ok := p.groups[version]
+		if !ok {
+			g = &scGroup{}
+			p.groups[version] = g
+		}
+		g.scs = append(g.scs, sc)
+		p.all.scs = append(p.all.scs, sc)
+	}
+	return p
+}
+
+type scGroup struct {
+	scs  []balancer.SubConn
+	next uint32
+}
+
+func (g *scGroup) pick() balancer.SubConn {
+	n := atomic.AddUint32(&g.next, 1)
+	return g.scs[int(n)%len(g.scs)]
+}
+
+// versionPicker picks a version by the weights of traffic split, then picks a sub conn of
+// the version in round robin. It picks from all sub conns if there is no rule for the client conn.
+type versionPicker struct {
+	groups       map[string]*scGroup
+	all          scGroup
+	trafficSplit *atomic.Value // TrafficSplit of the client conn
+}
+
+func (p *versionPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	ts, _ := p.trafficSplit.Load().(TrafficSplit)
+	if ts == nil {
+		return balancer.PickResult{SubConn: p.all.pick()}, nil
+	}
+
+	total := 0
+	for version, weight := range ts {
+		if _, ok := p.groups[version]; ok {
+			total += weight
+		}
+	}
+	if total == 0 {
+		// none of the versions in the rule is available
+		return balancer.PickResult{SubConn: p.all.pick()}, nil
+	}
+
+	n := rand.Intn(total) //nolint
+	for version, weight := range ts {
+		g, ok := p.groups[version]
+		if !ok {
+			continue
+		}
+		if n < weight {
+			return balancer.PickResult{SubConn: g.pick()}, nil
+		}
+		n -= weight
+	}
+	return balancer.PickResult{SubConn: p.all.pick()}, nil
+}
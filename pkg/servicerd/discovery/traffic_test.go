@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	version string
+}
+
+func TestParseTrafficSplit(t *testing.T) {
+	ts, err := ParseTrafficSplit("v1:90, v2:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts["v1"] != 90 || ts["v2"] != 10 || ts.String() != "v1:90,v2:10" {
+		t.Errorf("unexpected traffic split: %v", ts)
+	}
+
+	for _, rule := range []string{"", "v1", "v1:foo", "v1:-1", ":10"} {
+		if _, err = ParseTrafficSplit(rule); err == nil {
+			t.Errorf("expect error of %q", rule)
+		}
+	}
+}
+
+func TestVersionPicker(t *testing.T) {
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+	for i, version := range []string{"v1", "v1", "v2"} {
+		// the instance name differs from the target name, e.g. group prefixed names of nacos
+		in := registry.NewServiceInstance(string(rune('a'+i)), "DEFAULT_GROUP@@traffic-svc", nil, registry.WithVersion(version))
+		info.ReadySCs[&fakeSubConn{version: version}] = base.SubConnInfo{Address: resolver.Address{
+			ServerName: in.Name,
+			Attributes: attributes.New("rawServiceInstance", in),
+		}}
+	}
+	pb := &versionPickerBuilder{}
+	p := pb.Build(info)
+	// the picker builder of another client conn of the same service
+	other := &versionPickerBuilder{}
+	otherPicker := other.Build(info)
+
+	count := func(p balancer.Picker) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			res, err := p.Pick(balancer.PickInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[res.SubConn.(*fakeSubConn).version]++
+		}
+		return counts
+	}
+	setRule := func(pb *versionPickerBuilder, rule string) {
+		pb.trafficSplit.Store(trafficSplitFromState(withTrafficSplit(resolver.State{}, rule)))
+	}
+
+	// round robin without rule
+	if counts := count(p); counts["v2"] < 300 || counts["v2"] > 400 {
+		t.Errorf("unexpected counts without rule: %v", counts)
+	}
+
+	setRule(pb, "v1:0,v2:100")
+	if counts := count(p); counts["v2"] != 1000 {
+		t.Errorf("unexpected counts with rule v1:0,v2:100: %v", counts)
+	}
+	setRule(other, "v1:100,v2:0")
+	if counts := count(otherPicker); counts["v1"] != 1000 {
+		t.Errorf("unexpected counts of another client conn with rule v1:100,v2:0: %v", counts)
+	}
+
+	// hot reload
+	setRule(pb, "v1:90,v2:10")
+	if counts := count(p); counts["v2"] < 50 || counts["v2"] > 150 {
+		t.Errorf("unexpected counts with rule v1:90,v2:10: %v", counts)
+	}
+	setRule(pb, "")
+	if counts := count(p); counts["v2"] < 300 || counts["v2"] > 400 {
+		t.Errorf("unexpected counts after removing rule: %v", counts)
+	}
+}
+
+func (c *stateConn) trafficSplit() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return trafficSplitFromState(c.state).String()
+}
+
+func TestBuilder_WithTrafficSplit(t *testing.T) {
+	d1 := &chanDiscovery{ch: make(chan []*registry.ServiceInstance)}
+	d2 := &chanDiscovery{ch: make(chan []*registry.ServiceInstance)}
+	target := resolver.Target{URL: url.URL{Path: "/foo"}}
+	cc1, cc2 := &stateConn{}, &stateConn{}
+	r1, err := NewBuilder(d1, WithTrafficSplit("foo", "v1:90,v2:10"), WithInsecure(true), DisableDebugLog()).
+		Build(target, cc1, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	// a client conn of the same service without rule
+	r2, err := NewBuilder(d2, WithInsecure(true), DisableDebugLog()).Build(target, cc2, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+
+	instances := []*registry.ServiceInstance{registry.NewServiceInstance("a", "foo", []string{"grpc://127.0.0.1:8281"})}
+	d1.ch <- instances
+	d2.ch <- instances
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("got rules %q and %q", cc1.trafficSplit(), cc2.trafficSplit())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	waitFor(func() bool { return cc1.trafficSplit() == "v1:90,v2:10" && len(cc2.addrs()) == 1 })
+	if rule := cc2.trafficSplit(); rule != "" {
+		t.Fatalf("got rule %q of the client conn without rule", rule)
+	}
+
+	if err = SetTrafficSplit("foo", "v1:50,v2:50"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool { return cc1.trafficSplit() == "v1:50,v2:50" && cc2.trafficSplit() == "v1:50,v2:50" })
+	// the rules of builder options are restored
+	if err = SetTrafficSplit("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool { return cc1.trafficSplit() == "v1:90,v2:10" && cc2.trafficSplit() == "" })
+}
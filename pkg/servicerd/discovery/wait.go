@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// WaitForService blocks until at least minInstances instances of the service are discovered or ctx is done,
+// it returns the discovered instances, or an error if ctx is done before enough instances are found.
+func WaitForService(ctx context.Context, d registry.Discovery, serviceName string, minInstances int) ([]*registry.ServiceInstance, error) {
+	ins, err := d.GetService(ctx, serviceName)
+	if err == nil && len(ins) >= minInstances {
+		return ins, nil
+	}
+
+	w, err := d.Watch(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	stop := func() { once.Do(func() { _ = w.Stop() }) }
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// unblock Next of the watchers which do not observe ctx
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-done:
+		}
+	}()
+
+	found := len(ins)
+	waitErr := func() error {
+		return fmt.Errorf("wait for %d instances of %s, found %d: %w", minInstances, serviceName, found, ctx.Err())
+	}
+	backoff := time.Millisecond * 100
+	for {
+		ins, err = w.Next()
+		if ctx.Err() != nil {
+			return nil, waitErr()
+		}
+		if err != nil {
+			// the watcher may query the registry again at once
+			select {
+			case <-ctx.Done():
+				return nil, waitErr()
+			case <-time.After(backoff):
+			}
+			if backoff < time.Second*5 {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Millisecond * 100
+		found = len(ins)
+		if found >= minInstances {
+			return ins, nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc/resolver"
+)
+
+func TestWaitForService(t *testing.T) {
+	d := &chanDiscovery{ch: make(chan []*registry.ServiceInstance)}
+	a := registry.NewServiceInstance("a", "foo", []string{"grpc://127.0.0.1:8281"})
+	b := registry.NewServiceInstance("b", "foo", []string{"grpc://127.0.0.1:8282"})
+	go func() {
+		d.ch <- []*registry.ServiceInstance{a}
+		d.ch <- []*registry.ServiceInstance{a, b}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ins, err := WaitForService(ctx, d, "foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 2 {
+		t.Errorf("got %d instances, want 2", len(ins))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = WaitForService(ctx, d, "foo", 1)
+	if err == nil {
+		t.Error("expect timeout error")
+	}
+}
+
+func TestBuilder_WithWaitForInstances(t *testing.T) {
+	d := &chanDiscovery{ch: make(chan []*registry.ServiceInstance)}
+	b := NewBuilder(d, WithWaitForInstances(1, time.Second), WithInsecure(true), DisableDebugLog())
+	go func() {
+		d.ch <- []*registry.ServiceInstance{registry.NewServiceInstance("a", "foo", []string{"grpc://127.0.0.1:8281"})}
+	}()
+
+	cc := &stateConn{}
+	r, err := b.Build(resolver.Target{URL: url.URL{Path: "/foo"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if addrs := cc.addrs(); len(addrs) != 1 {
+		t.Errorf("got addrs %v after Build, want 1 address", addrs)
+	}
+}
+
+type errWatcher struct {
+	nexts atomic.Int32
+}
+
+func (w *errWatcher) Next() ([]*registry.ServiceInstance, error) {
+	w.nexts.Add(1)
+	return nil, errors.New("connection refused")
+}
+
+func (w *errWatcher) Stop() error { return nil }
+
+type errWatchDiscovery struct {
+	discovery
+	w *errWatcher
+}
+
+func (d *errWatchDiscovery) Watch(context.Context, string) (registry.Watcher, error) {
+	return d.w, nil
+}
+
+func TestWaitForService_backoff(t *testing.T) {
+	d := &errWatchDiscovery{w: &errWatcher{}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	_, err := WaitForService(ctx, d, "foo", 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want deadline exceeded", err)
+	}
+	// 100ms, 200ms, 400ms
+	if n := d.w.nexts.Load(); n > 4 {
+		t.Errorf("got %d calls of Next, want backoff after errors", n)
+	}
+}
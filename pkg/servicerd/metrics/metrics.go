@@ -0,0 +1,184 @@
+// Package metrics is prometheus metrics of service registration and discovery.
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "sponge_servicerd"
+
+// Metrics is a set of prometheus collectors for service registration and discovery,
+// a nil *Metrics is valid and all of its methods do nothing.
+type Metrics struct {
+	registerTotal         *prometheus.CounterVec
+	registerFailuresTotal *prometheus.CounterVec
+	heartbeatTotal        *prometheus.CounterVec
+	registrationEvents    *prometheus.CounterVec
+	watcherErrorsTotal    *prometheus.CounterVec
+	watcherReconnectTotal *prometheus.CounterVec
+	resolverUpdatesTotal  *prometheus.CounterVec
+	resolverUpdateSeconds *prometheus.HistogramVec
+	instances             *prometheus.GaugeVec
+	requestSeconds        *prometheus.HistogramVec
+}
+
+// New creates the collectors and registers them to reg, if reg is nil, prometheus.DefaultRegisterer is used.
+// Collectors that have been registered to reg before are reused, so it is safe to call New more than once.
+func New(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &Metrics{
+		registerTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "register_total",
+			Help:      "Total number of service registration attempts.",
+		}, []string{"backend"}),
+		registerFailuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "register_failures_total",
+			Help:      "Total number of failed service registrations.",
+		}, []string{"backend"}),
+		heartbeatTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "heartbeat_total",
+			Help:      "Total number of heartbeats or lease renewals.",
+		}, []string{"backend"}),
+		registrationEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "registration_events_total",
+			Help:      "Total number of registration lifecycle events, e.g. lease_lost and give_up.",
+		}, []string{"backend", "event"}),
+		watcherErrorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "watcher_errors_total",
+			Help:      "Total number of errors while watching services.",
+		}, []string{"backend", "service"}),
+		watcherReconnectTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "watcher_reconnects_total",
+			Help:      "Total number of watcher recoveries after an error.",
+		}, []string{"backend", "service"}),
+		resolverUpdatesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "resolver_updates_total",
+			Help:      "Total number of resolver state updates.",
+		}, []string{"service"}),
+		resolverUpdateSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "resolver_update_duration_seconds",
+			Help:      "Latency of resolver state updates.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service"}),
+		instances: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "instances",
+			Help:      "Current number of discovered instances.",
+		}, []string{"service"}),
+		requestSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "registry_request_duration_seconds",
+			Help:      "Latency of requests to the registry.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"backend", "operation"}),
+	}
+
+	m.registerTotal = register(reg, m.registerTotal)
+	m.registerFailuresTotal = register(reg, m.registerFailuresTotal)
+	m.heartbeatTotal = register(reg, m.heartbeatTotal)
+	m.registrationEvents = register(reg, m.registrationEvents)
+	m.watcherErrorsTotal = register(reg, m.watcherErrorsTotal)
+	m.watcherReconnectTotal = register(reg, m.watcherReconnectTotal)
+	m.resolverUpdatesTotal = register(reg, m.resolverUpdatesTotal)
+	m.resolverUpdateSeconds = register(reg, m.resolverUpdateSeconds)
+	m.instances = register(reg, m.instances)
+	m.requestSeconds = register(reg, m.requestSeconds)
+
+	return m
+}
+
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) T {
+	err := reg.Register(c)
+	if err == nil {
+		return c
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	return c
+}
+
+// Register records a registration attempt, err is the result of the registration.
+func (m *Metrics) Register(backend string, err error) {
+	if m == nil {
+		return
+	}
+	m.registerTotal.WithLabelValues(backend).Inc()
+	if err != nil {
+		m.registerFailuresTotal.WithLabelValues(backend).Inc()
+	}
+}
+
+// Heartbeat records a heartbeat or lease renewal.
+func (m *Metrics) Heartbeat(backend string) {
+	if m == nil {
+		return
+	}
+	m.heartbeatTotal.WithLabelValues(backend).Inc()
+}
+
+// RegistrationEvent records a lifecycle event of a registration.
+func (m *Metrics) RegistrationEvent(backend string, event string) {
+	if m == nil {
+		return
+	}
+	m.registrationEvents.WithLabelValues(backend, event).Inc()
+}
+
+// WatcherError records an error while watching the service.
+func (m *Metrics) WatcherError(backend string, service string) {
+	if m == nil {
+		return
+	}
+	m.watcherErrorsTotal.WithLabelValues(backend, service).Inc()
+}
+
+// WatcherReconnect records a watcher recovery after an error.
+func (m *Metrics) WatcherReconnect(backend string, service string) {
+	if m == nil {
+		return
+	}
+	m.watcherReconnectTotal.WithLabelValues(backend, service).Inc()
+}
+
+// ResolverUpdate records a resolver state update which started at start.
+func (m *Metrics) ResolverUpdate(service string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.resolverUpdatesTotal.WithLabelValues(service).Inc()
+	m.resolverUpdateSeconds.WithLabelValues(service).Observe(time.Since(start).Seconds())
+}
+
+// Instances set the current number of discovered instances.
+func (m *Metrics) Instances(service string, n int) {
+	if m == nil {
+		return
+	}
+	m.instances.WithLabelValues(service).Set(float64(n))
+}
+
+// Request records a registry request which started at start.
+func (m *Metrics) Request(backend string, operation string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.requestSeconds.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+}
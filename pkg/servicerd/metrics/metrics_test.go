@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+
+	m.Register("etcd", nil)
+	m.Register("etcd", errors.New("foo"))
+	m.Heartbeat("etcd")
+	m.RegistrationEvent("etcd", "lease_lost")
+	m.WatcherError("etcd", "foo")
+	m.WatcherReconnect("etcd", "foo")
+	m.ResolverUpdate("foo", time.Now())
+	m.Instances("foo", 3)
+	m.Request("etcd", "register", time.Now())
+
+	if v := testutil.ToFloat64(m.registerTotal.WithLabelValues("etcd")); v != 2 {
+		t.Errorf("register_total = %v, want 2", v)
+	}
+	if v := testutil.ToFloat64(m.registerFailuresTotal.WithLabelValues("etcd")); v != 1 {
+		t.Errorf("register_failures_total = %v, want 1", v)
+	}
+	if v := testutil.ToFloat64(m.registrationEvents.WithLabelValues("etcd", "lease_lost")); v != 1 {
+		t.Errorf("registration_events_total = %v, want 1", v)
+	}
+	if v := testutil.ToFloat64(m.instances.WithLabelValues("foo")); v != 3 {
+		t.Errorf("instances = %v, want 3", v)
+	}
+
+	// register again, the collectors are reused
+	m2 := New(reg)
+	m2.Heartbeat("etcd")
+	if v := testutil.ToFloat64(m.heartbeatTotal.WithLabelValues("etcd")); v != 2 {
+		t.Errorf("heartbeat_total = %v, want 2", v)
+	}
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *Metrics
+	m.Register("etcd", nil)
+	m.Heartbeat("etcd")
+	m.RegistrationEvent("etcd", "lease_lost")
+	m.WatcherError("etcd", "foo")
+	m.WatcherReconnect("etcd", "foo")
+	m.ResolverUpdate("foo", time.Now())
+	m.Instances("foo", 1)
+	m.Request("etcd", "register", time.Now())
+}
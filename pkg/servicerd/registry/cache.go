@@ -0,0 +1,238 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	_ Discovery    = (*CachedDiscovery)(nil)
+	_ ConfigGetter = (*CachedDiscovery)(nil)
+)
+
+// fetchTimeout is the timeout of fetching the instances shared by the concurrent misses of a service.
+const fetchTimeout = time.Second * 10
+
+// CacheOption set the cached discovery options.
+type CacheOption func(*cacheOptions)
+
+type cacheOptions struct {
+	ttl time.Duration
+}
+
+func defaultCacheOptions() *cacheOptions {
+	return &cacheOptions{
+		ttl: time.Second * 10,
+	}
+}
+
+func (o *cacheOptions) apply(opts ...CacheOption) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithCacheTTL set the ttl of instances fetched directly when the watcher of the service is not available.
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(o *cacheOptions) {
+		o.ttl = ttl
+	}
+}
+
+// CachedDiscovery is a Discovery which answers GetService from an in-memory view of each service,
+// the view is kept up to date by a watcher started at the first GetService of the service. Concurrent
+// misses of a service are coalesced into one fetch, and if the watcher is not available, the instances
+// are fetched directly from the registry and cached for a ttl.
+type CachedDiscovery struct {
+	d    Discovery
+	opts *cacheOptions
+
+	group   singleflight.Group
+	mu      sync.RWMutex
+	entries map[string]*cacheEntry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type cacheEntry struct {
+	instances []*ServiceInstance
+	watched   bool // instances are up to date with the watcher
+	updatedAt time.Time
+	w         Watcher
+	ready     chan struct{} // closed when the watcher gets the first instances
+	readyOnce sync.Once
+}
+
+// NewCachedDiscovery creates a cached discovery of d, call Close to stop the watchers.
+func NewCachedDiscovery(d Discovery, opts ...CacheOption) *CachedDiscovery {
+	o := defaultCacheOptions()
+	o.apply(opts...)
+
+	c := &CachedDiscovery{
+		d:       d,
+		opts:    o,
+		entries: make(map[string]*cacheEntry),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// GetService return the service instances in memory according to the service name.
+func (c *CachedDiscovery) GetService(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	if ins, ok := c.get(serviceName); ok {
+		return ins, nil
+	}
+
+	// the shared fetch is not cancelled by the caller which starts it, every caller waits on its own ctx
+	ch := c.group.DoChan(serviceName, func() (interface{}, error) {
+		if ins, ok := c.get(serviceName); ok {
+			return ins, nil
+		}
+		e := c.watch(serviceName)
+
+		fetchCtx, cancel := context.WithTimeout(c.ctx, fetchTimeout)
+		defer cancel()
+		ins, err := c.d.GetService(fetchCtx, serviceName)
+		if err == nil {
+			c.mu.Lock()
+			if !e.watched {
+				e.instances = ins
+				e.updatedAt = time.Now()
+			}
+			c.mu.Unlock()
+			return ins, nil
+		}
+
+		// some registries can't get service before watching, wait for the watcher
+		select {
+		case <-e.ready:
+			ins, _ = c.get(serviceName)
+			return ins, nil
+		case <-fetchCtx.Done():
+			return nil, err
+		case <-time.After(c.opts.ttl):
+			return nil, err
+		}
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		ins := r.Val.([]*ServiceInstance)
+		return append(make([]*ServiceInstance, 0, len(ins)), ins...), nil
+	}
+}
+
+// Watch creates a watcher according to the service name.
+func (c *CachedDiscovery) Watch(ctx context.Context, serviceName string) (Watcher, error) {
+	return c.d.Watch(ctx, serviceName)
+}
+
+// GetConfig returns the configuration of the service by key if the wrapped discovery implements ConfigGetter.
+func (c *CachedDiscovery) GetConfig(ctx context.Context, serviceName string, key string) (string, error) {
+	if cg, ok := c.d.(ConfigGetter); ok {
+		return cg.GetConfig(ctx, serviceName, key)
+	}
+	return "", nil
+}
+
+// Close stops all watchers of the cached services, and closes the wrapped discovery if it implements io.Closer.
+func (c *CachedDiscovery) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	for name, e := range c.entries {
+		if e.w != nil {
+			_ = e.w.Stop()
+		}
+		delete(c.entries, name)
+	}
+	c.mu.Unlock()
+	if closer, ok := c.d.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// get returns the cached instances if they are watched or not expired.
+func (c *CachedDiscovery) get(serviceName string) ([]*ServiceInstance, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.entries[serviceName]
+	if !ok || e.updatedAt.IsZero() {
+		return nil, false
+	}
+	if !e.watched && time.Since(e.updatedAt) > c.opts.ttl {
+		return nil, false
+	}
+	return append(make([]*ServiceInstance, 0, len(e.instances)), e.instances...), true
+}
+
+// watch starts the watcher of the service if it has not been started.
+func (c *CachedDiscovery) watch(serviceName string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[serviceName]
+	if ok {
+		return e
+	}
+	e = &cacheEntry{ready: make(chan struct{})}
+	c.entries[serviceName] = e
+	go c.run(serviceName, e)
+	return e
+}
+
+func (c *CachedDiscovery) run(serviceName string, e *cacheEntry) {
+	var (
+		w   Watcher
+		err error
+	)
+	for {
+		w, err = c.d.Watch(c.ctx, serviceName)
+		if err == nil {
+			break
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		_ = w.Stop()
+		return
+	}
+	e.w = w
+	c.mu.Unlock()
+
+	for {
+		ins, err := w.Next()
+		if c.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// fall back to direct fetch until the watcher recovers
+			c.mu.Lock()
+			e.watched = false
+			c.mu.Unlock()
+			time.Sleep(time.Second)
+			continue
+		}
+		c.mu.Lock()
+		e.instances = ins
+		e.watched = true
+		e.updatedAt = time.Now()
+		c.mu.Unlock()
+		e.readyOnce.Do(func() { close(e.ready) })
+	}
+}
@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countDiscovery struct {
+	gets      int32
+	getErr    error
+	delay     time.Duration
+	instances []*ServiceInstance
+	ch        chan []*ServiceInstance
+}
+
+func (d *countDiscovery) GetService(ctx context.Context, _ string) ([]*ServiceInstance, error) {
+	atomic.AddInt32(&d.gets, 1)
+	select {
+	case <-time.After(d.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if d.getErr != nil {
+		return nil, d.getErr
+	}
+	return d.instances, nil
+}
+
+func (d *countDiscovery) Watch(ctx context.Context, _ string) (Watcher, error) {
+	return &chanWatcher{ctx: ctx, ch: d.ch}, nil
+}
+
+type chanWatcher struct {
+	ctx context.Context
+	ch  chan []*ServiceInstance
+}
+
+func (w *chanWatcher) Next() ([]*ServiceInstance, error) {
+	select {
+	case ins := <-w.ch:
+		return ins, nil
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	}
+}
+
+func (w *chanWatcher) Stop() error { return nil }
+
+func TestCachedDiscovery_singleflight(t *testing.T) {
+	d := &countDiscovery{
+		delay:     time.Millisecond * 100,
+		instances: []*ServiceInstance{{ID: "1", Name: "foo"}},
+		ch:        make(chan []*ServiceInstance),
+	}
+	c := NewCachedDiscovery(d, WithCacheTTL(time.Minute))
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ins, err := c.GetService(context.Background(), "foo")
+			if err != nil || len(ins) != 1 {
+				t.Errorf("GetService() = %v, %v", ins, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&d.gets); n != 1 {
+		t.Fatalf("got %d fetches, want 1", n)
+	}
+
+	// answered from cache
+	_, _ = c.GetService(context.Background(), "foo")
+	if n := atomic.LoadInt32(&d.gets); n != 1 {
+		t.Fatalf("got %d fetches, want 1", n)
+	}
+}
+
+func TestCachedDiscovery_singleflightCancel(t *testing.T) {
+	d := &countDiscovery{
+		delay:     time.Millisecond * 100,
+		instances: []*ServiceInstance{{ID: "1", Name: "foo"}},
+		ch:        make(chan []*ServiceInstance),
+	}
+	c := NewCachedDiscovery(d, WithCacheTTL(time.Minute))
+	defer c.Close()
+
+	// the caller starting the fetch is cancelled, the others waiting on the same fetch get the instances
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.GetService(ctx, "foo")
+		first <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	second := make(chan error, 1)
+	go func() {
+		ins, err := c.GetService(context.Background(), "foo")
+		if err == nil && len(ins) != 1 {
+			err = errors.New("instances are not fetched")
+		}
+		second <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	cancel()
+
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context canceled", err)
+	}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&d.gets); n != 1 {
+		t.Fatalf("got %d fetches, want 1", n)
+	}
+}
+
+func TestCachedDiscovery_watch(t *testing.T) {
+	d := &countDiscovery{
+		getErr: errors.New("not resolved"),
+		ch:     make(chan []*ServiceInstance, 1),
+	}
+	c := NewCachedDiscovery(d, WithCacheTTL(time.Second))
+	defer c.Close()
+
+	d.ch <- []*ServiceInstance{{ID: "1", Name: "foo"}}
+	ins, err := c.GetService(context.Background(), "foo")
+	if err != nil || len(ins) != 1 {
+		t.Fatalf("GetService() = %v, %v", ins, err)
+	}
+
+	d.ch <- []*ServiceInstance{{ID: "1", Name: "foo"}, {ID: "2", Name: "foo"}}
+	time.Sleep(time.Millisecond * 50)
+	ins, err = c.GetService(context.Background(), "foo")
+	if err != nil || len(ins) != 2 {
+		t.Fatalf("GetService() = %v, %v", ins, err)
+	}
+	if n := atomic.LoadInt32(&d.gets); n != 1 {
+		t.Fatalf("got %d fetches, want 1", n)
+	}
+}
+
+func TestCachedDiscovery_ttl(t *testing.T) {
+	d := &countDiscovery{
+		instances: []*ServiceInstance{{ID: "1", Name: "foo"}},
+		ch:        make(chan []*ServiceInstance),
+	}
+	c := NewCachedDiscovery(d, WithCacheTTL(time.Millisecond*50))
+	defer c.Close()
+
+	_, _ = c.GetService(context.Background(), "foo")
+	_, _ = c.GetService(context.Background(), "foo")
+	if n := atomic.LoadInt32(&d.gets); n != 1 {
+		t.Fatalf("got %d fetches, want 1", n)
+	}
+	time.Sleep(time.Millisecond * 100)
+	_, _ = c.GetService(context.Background(), "foo")
+	if n := atomic.LoadInt32(&d.gets); n != 2 {
+		t.Fatalf("got %d fetches, want 2", n)
+	}
+}
+
+func TestCachedDiscovery_error(t *testing.T) {
+	d := &countDiscovery{
+		getErr: errors.New("not found"),
+		ch:     make(chan []*ServiceInstance),
+	}
+	c := NewCachedDiscovery(d, WithCacheTTL(time.Millisecond*50))
+	defer c.Close()
+
+	_, err := c.GetService(context.Background(), "foo")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -2,12 +2,16 @@ package consul
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/url"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 
 	"github.com/hashicorp/consul/api"
@@ -15,26 +19,49 @@ import (
 
 // Client is consul client config
 type Client struct {
-	client *api.Client
-	ctx    context.Context
-	cancel context.CancelFunc
+	client  *api.Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	metrics *metrics.Metrics
+	hooks   *registry.Hooks
+
+	checkInterval time.Duration // interval of checking the registration
+
+	mu            sync.Mutex
+	lastHeartbeat time.Time
+	registrations map[string]*registration // service id -> registration
+}
+
+// registration is a registered service, the keeper registers the latest registration again after it is lost.
+type registration struct {
+	asr     *api.AgentServiceRegistration // replaced by Update
+	drained bool                          // the service is in maintenance mode
+	cancel  context.CancelFunc            // stops the keeper and TTL updates
 }
 
 // NewClient creates consul client
 func NewClient(cli *api.Client) *Client {
-	c := &Client{client: cli}
+	c := &Client{
+		client:        cli,
+		checkInterval: time.Second * 20,
+		registrations: make(map[string]*registration),
+	}
 	c.ctx, c.cancel = context.WithCancel(context.Background())
 	return c
 }
 
-// Service get services from consul
+// Service get services from consul, the services in maintenance mode are returned as draining even if
+// passingOnly is true, so that the resolvers stop using them instead of keeping the last addresses.
 func (d *Client) Service(ctx context.Context, service string, index uint64, passingOnly bool) ([]*registry.ServiceInstance, uint64, error) {
 	opts := &api.QueryOptions{
 		WaitIndex: index,
 		WaitTime:  time.Second * 55,
 	}
 	opts = opts.WithContext(ctx)
-	entries, meta, err := d.client.Health().Service(service, "", passingOnly, opts)
+	start := time.Now()
+	// the passing filter of consul excludes the services in maintenance mode, filter them here
+	entries, meta, err := d.client.Health().Service(service, "", false, opts)
+	d.metrics.Request(backend, "service", start)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -42,6 +69,10 @@ func (d *Client) Service(ctx context.Context, service string, index uint64, pass
 	services := make([]*registry.ServiceInstance, 0)
 
 	for _, entry := range entries {
+		status := entry.Checks.AggregatedStatus()
+		if passingOnly && status != api.HealthPassing && status != api.HealthMaint {
+			continue
+		}
 		var version string
 		for _, tag := range entry.Service.Tags {
 			strs := strings.SplitN(tag, "=", 2)
@@ -56,53 +87,66 @@ func (d *Client) Service(ctx context.Context, service string, index uint64, pass
 			}
 			endpoints = append(endpoints, addr.Address)
 		}
-		services = append(services, &registry.ServiceInstance{
+		si := &registry.ServiceInstance{
 			ID:        entry.Service.ID,
 			Name:      entry.Service.Service,
 			Metadata:  entry.Service.Meta,
 			Version:   version,
 			Endpoints: endpoints,
-		})
+		}
+		if status == api.HealthMaint {
+			si = registry.Draining(si)
+		}
+		services = append(services, si)
 	}
 	return services, meta.LastIndex, nil
 }
 
 // Register register service instance to consul
 func (d *Client) Register(_ context.Context, svc *registry.ServiceInstance, enableHealthCheck bool) error {
-	addresses := make(map[string]api.ServiceAddress)
-	var addr string
-	var port uint64
-	for _, endpoint := range svc.Endpoints {
-		raw, err := url.Parse(endpoint)
-		if err != nil {
-			return err
-		}
-		addr = raw.Hostname()
-		port, _ = strconv.ParseUint(raw.Port(), 10, 16)
-		addresses[raw.Scheme] = api.ServiceAddress{Address: endpoint, Port: int(port)}
-	}
-	asr := &api.AgentServiceRegistration{
-		ID:              svc.ID,
-		Name:            svc.Name,
-		Meta:            svc.Metadata,
-		Tags:            []string{fmt.Sprintf("version=%s", svc.Version)},
-		TaggedAddresses: addresses,
-		Address:         addr,
-		Port:            int(port),
+	asr, err := newRegistration(svc)
+	if err != nil {
+		return err
 	}
 	if enableHealthCheck {
 		asr.Checks = append(asr.Checks, &api.AgentServiceCheck{
-			TCP:                            fmt.Sprintf("%s:%d", addr, port),
+			TCP:                            net.JoinHostPort(asr.Address, strconv.Itoa(asr.Port)),
 			Interval:                       "20s",
 			Timeout:                        "5s",
 			Status:                         "passing",
 			DeregisterCriticalServiceAfter: "60s",
 		})
 	}
-	err := d.client.Agent().ServiceRegister(asr)
+	start := time.Now()
+	err = d.client.Agent().ServiceRegister(asr)
+	d.metrics.Request(backend, "register", start)
+	d.metrics.Register(backend, err)
 	if err != nil {
 		return err
 	}
+	d.hooks.Registered(svc)
+
+	// the service is removed after it is critical for a while or the agent restarts without the registration
+	keeper := &registry.Keeper{
+		Service:  svc,
+		Hooks:    d.hooks,
+		Interval: d.checkInterval,
+		MaxRetry: 5,
+		Exists: func(ctx context.Context) (bool, error) {
+			return d.serviceExists(ctx, svc.ID)
+		},
+		Register: func(ctx context.Context) error {
+			return d.reregister(ctx, svc.ID)
+		},
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.mu.Lock()
+	if old, ok := d.registrations[svc.ID]; ok {
+		old.cancel()
+	}
+	d.registrations[svc.ID] = &registration{asr: asr, cancel: cancel}
+	d.mu.Unlock()
+	go keeper.Run(ctx)
 
 	go func() {
 		ticker := time.NewTicker(time.Second * 20)
@@ -110,8 +154,11 @@ func (d *Client) Register(_ context.Context, svc *registry.ServiceInstance, enab
 		for {
 			select {
 			case <-ticker.C:
-				_ = d.client.Agent().UpdateTTL("service:"+svc.ID, "pass", "pass")
-			case <-d.ctx.Done():
+				if err := d.client.Agent().UpdateTTL("service:"+svc.ID, "pass", "pass"); err == nil {
+					d.setLastHeartbeat(time.Now())
+					d.metrics.Heartbeat(backend)
+				}
+			case <-ctx.Done():
 				return
 			}
 		}
@@ -119,8 +166,153 @@ func (d *Client) Register(_ context.Context, svc *registry.ServiceInstance, enab
 	return nil
 }
 
-// Deregister deregister service by service ID
-func (d *Client) Deregister(_ context.Context, serviceID string) error {
+// reregister registers the latest registration of the service again, and puts it into maintenance mode
+// again if it is drained.
+func (d *Client) reregister(ctx context.Context, serviceID string) error {
+	d.mu.Lock()
+	reg, ok := d.registrations[serviceID]
+	var asr *api.AgentServiceRegistration
+	var drained bool
+	if ok {
+		asr, drained = reg.asr, reg.drained
+	}
+	d.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("service %s is deregistered", serviceID)
+	}
+
+	err := d.client.Agent().ServiceRegisterOpts(asr, api.ServiceRegisterOpts{}.WithContext(ctx))
+	d.metrics.Register(backend, err)
+	if err != nil || !drained {
+		return err
+	}
+	return d.client.Agent().EnableServiceMaintenanceOpts(serviceID, "draining", (&api.QueryOptions{}).WithContext(ctx))
+}
+
+// serviceExists reports whether the service is registered in the agent.
+func (d *Client) serviceExists(ctx context.Context, serviceID string) (bool, error) {
+	_, _, err := d.client.Agent().Service(serviceID, (&api.QueryOptions{}).WithContext(ctx))
+	if err == nil {
+		return true, nil
+	}
+	var se api.StatusError
+	if errors.As(err, &se) && se.Code == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
+}
+
+// Update re-registers the service instance without checks, so that the existing checks are preserved
+func (d *Client) Update(ctx context.Context, svc *registry.ServiceInstance) error {
+	asr, err := newRegistration(svc)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = d.client.Agent().ServiceRegisterOpts(asr, api.ServiceRegisterOpts{ReplaceExistingChecks: false}.WithContext(ctx))
+	d.metrics.Request(backend, "update", start)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if reg, ok := d.registrations[svc.ID]; ok {
+		asr.Checks = reg.asr.Checks
+		reg.asr = asr
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// EnableMaintenance puts the service into maintenance mode
+func (d *Client) EnableMaintenance(ctx context.Context, serviceID string, reason string) error {
+	start := time.Now()
+	err := d.client.Agent().EnableServiceMaintenanceOpts(serviceID, reason, (&api.QueryOptions{}).WithContext(ctx))
+	d.metrics.Request(backend, "drain", start)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if reg, ok := d.registrations[serviceID]; ok {
+		reg.drained = true
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// Close stops the keepers and TTL updates of the registered services
+func (d *Client) Close() {
 	d.cancel()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, reg := range d.registrations {
+		reg.cancel()
+		delete(d.registrations, id)
+	}
+}
+
+// newRegistration converts the service instance to consul service registration without checks
+func newRegistration(svc *registry.ServiceInstance) (*api.AgentServiceRegistration, error) {
+	if err := svc.Validate(); err != nil {
+		return nil, err
+	}
+	addresses := make(map[string]api.ServiceAddress)
+	var addr string
+	var port int
+	for _, endpoint := range svc.Endpoints {
+		e, err := registry.ParseEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		addr = e.Host
+		port = e.Port
+		addresses[e.Scheme] = api.ServiceAddress{Address: endpoint, Port: e.Port}
+	}
+	return &api.AgentServiceRegistration{
+		ID:              svc.ID,
+		Name:            svc.Name,
+		Meta:            svc.Metadata,
+		Tags:            []string{fmt.Sprintf("version=%s", svc.Version)},
+		TaggedAddresses: addresses,
+		Address:         addr,
+		Port:            port,
+	}, nil
+}
+
+// GetConfig get value of key from consul KV, empty if not found
+func (d *Client) GetConfig(ctx context.Context, key string) (string, error) {
+	opts := (&api.QueryOptions{}).WithContext(ctx)
+	defer d.metrics.Request(backend, "get_config", time.Now())
+	pair, _, err := d.client.KV().Get(key, opts)
+	if err != nil {
+		return "", err
+	}
+	if pair == nil {
+		return "", nil
+	}
+	return string(pair.Value), nil
+}
+
+// LastHeartbeat returns the time of the last successful TTL update.
+func (d *Client) LastHeartbeat() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastHeartbeat
+}
+
+func (d *Client) setLastHeartbeat(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastHeartbeat = t
+}
+
+// Deregister deregister service by service ID, the keeper and TTL updates of the service are stopped
+func (d *Client) Deregister(_ context.Context, serviceID string) error {
+	d.mu.Lock()
+	if reg, ok := d.registrations[serviceID]; ok {
+		reg.cancel()
+		delete(d.registrations, serviceID)
+	}
+	d.mu.Unlock()
+	defer d.metrics.Request(backend, "deregister", time.Now())
 	return d.client.Agent().ServiceDeregister(serviceID)
 }
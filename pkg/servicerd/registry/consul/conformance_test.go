@@ -0,0 +1,155 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/registrytest"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeAgent is a consul agent which keeps the registered services in memory,
+// the health queries are blocking queries like consul.
+type fakeAgent struct {
+	mu       sync.Mutex
+	index    uint64
+	services map[string]*api.AgentServiceRegistration
+	changed  chan struct{} // closed and replaced on every change
+	failures int           // number of registrations to fail
+
+	maintenance map[string]bool // ids of the services in maintenance mode
+}
+
+func newFakeAgent() *fakeAgent {
+	return &fakeAgent{
+		index:    1,
+		services: make(map[string]*api.AgentServiceRegistration),
+		changed:  make(chan struct{}),
+
+		maintenance: make(map[string]bool),
+	}
+}
+
+func (a *fakeAgent) change(fn func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fn()
+	a.index++
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+func (a *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		asr := &api.AgentServiceRegistration{}
+		if err := json.NewDecoder(r.Body).Decode(asr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.mu.Lock()
+		fail := a.failures > 0
+		if fail {
+			a.failures--
+		}
+		a.mu.Unlock()
+		if fail {
+			http.Error(w, "register failed", http.StatusInternalServerError)
+			return
+		}
+		a.change(func() { a.services[asr.ID] = asr })
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		a.change(func() { delete(a.services, id) })
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/maintenance/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/maintenance/")
+		a.change(func() { a.maintenance[id] = r.URL.Query().Get("enable") == "true" })
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/") && r.Method == http.MethodGet:
+		a.mu.Lock()
+		asr, ok := a.services[strings.TrimPrefix(r.URL.Path, "/v1/agent/service/")]
+		a.mu.Unlock()
+		if !ok {
+			http.Error(w, "unknown service", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&api.AgentService{ID: asr.ID, Service: asr.Name})
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		a.health(w, r, strings.TrimPrefix(r.URL.Path, "/v1/health/service/"))
+	}
+}
+
+// health returns the services of name after the index changes from the index of the query.
+func (a *fakeAgent) health(w http.ResponseWriter, r *http.Request, name string) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	timeout := time.NewTimer(time.Second)
+	defer timeout.Stop()
+	for {
+		a.mu.Lock()
+		idx, changed := a.index, a.changed
+		entries := make([]*api.ServiceEntry, 0)
+		for _, asr := range a.services {
+			if asr.Name != name {
+				continue
+			}
+			entry := &api.ServiceEntry{Service: &api.AgentService{
+				ID:              asr.ID,
+				Service:         asr.Name,
+				Tags:            asr.Tags,
+				Meta:            asr.Meta,
+				Address:         asr.Address,
+				Port:            asr.Port,
+				TaggedAddresses: asr.TaggedAddresses,
+			}}
+			if a.maintenance[asr.ID] {
+				entry.Checks = api.HealthChecks{{CheckID: api.ServiceMaintPrefix + asr.ID, Status: api.HealthCritical}}
+			}
+			if r.URL.Query().Has("passing") && len(entry.Checks) > 0 {
+				continue // like consul, the services in maintenance mode are not passing
+			}
+			entries = append(entries, entry)
+		}
+		a.mu.Unlock()
+
+		if idx != index {
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(idx, 10))
+			_ = json.NewEncoder(w).Encode(entries)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			index = 0 // return the current services like the wait time of consul expires
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	registrytest.RunConformance(t, func(t *testing.T) *registrytest.Backend {
+		srv := httptest.NewServer(newFakeAgent())
+		t.Cleanup(srv.Close)
+
+		newRegistry := func() *Registry {
+			cli, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := New(cli, WithHealthCheck(false))
+			t.Cleanup(func() { _ = r.Close() })
+			return r
+		}
+		return &registrytest.Backend{
+			NewRegistry: func() registry.Registry { return newRegistry() },
+			Discovery:   newRegistry(),
+		}
+	})
+}
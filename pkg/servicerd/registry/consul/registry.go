@@ -4,19 +4,26 @@ package consul
 import (
 	"context"
 	"fmt"
+	"io"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/consulcli"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 
 	"github.com/hashicorp/consul/api"
 )
 
+const backend = "consul"
+
 var (
-	_ registry.Registry  = &Registry{}
-	_ registry.Discovery = &Registry{}
+	_ registry.Registry     = &Registry{}
+	_ registry.Discovery    = &Registry{}
+	_ registry.ConfigGetter = &Registry{}
+	_ registry.Updater      = &Registry{}
+	_ registry.Drainer      = &Registry{}
+	_ io.Closer             = &Registry{}
 )
 
 // Option is consul registry option.
@@ -29,6 +36,28 @@ func WithHealthCheck(enable bool) Option {
 	}
 }
 
+// WithMetrics set prometheus metrics.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *Registry) {
+		o.metrics = m
+	}
+}
+
+// WithHooks set the hooks of registration lifecycle events, the registration is lost when the service is
+// not found in the agent, e.g. it is removed after being critical for a while.
+func WithHooks(hooks *registry.Hooks) Option {
+	return func(o *Registry) {
+		o.hooks = hooks
+	}
+}
+
+// WithConfigPrefix set the prefix of KV keys of service configurations, default microservices_config.
+func WithConfigPrefix(prefix string) Option {
+	return func(o *Registry) {
+		o.configPrefix = prefix
+	}
+}
+
 // Config is consul registry config
 type Config struct {
 	*api.Config
@@ -40,6 +69,13 @@ type Registry struct {
 	enableHealthCheck bool
 	registry          map[string]*serviceSet
 	lock              sync.RWMutex
+	metrics           *metrics.Metrics
+	hooks             *registry.Hooks
+	configPrefix      string
+
+	// cancelled by Close, stops resolving services
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewRegistry instantiating the consul registry
@@ -61,10 +97,14 @@ func New(apiClient *api.Client, opts ...Option) *Registry {
 		cli:               NewClient(apiClient),
 		registry:          make(map[string]*serviceSet),
 		enableHealthCheck: true,
+		configPrefix:      "microservices_config",
 	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
 	for _, opt := range opts {
 		opt(r)
 	}
+	r.cli.metrics = r.metrics
+	r.cli.hooks = r.hooks
 	return r
 }
 
@@ -73,12 +113,27 @@ func (r *Registry) Register(ctx context.Context, svc *registry.ServiceInstance)
 	return r.cli.Register(ctx, svc, r.enableHealthCheck)
 }
 
+// Update updates the registered service in place, the health checks of the service are preserved.
+func (r *Registry) Update(ctx context.Context, svc *registry.ServiceInstance) error {
+	return r.cli.Update(ctx, svc)
+}
+
+// Drain puts the service into maintenance mode, the discoveries deliver it with metadata status=draining.
+func (r *Registry) Drain(ctx context.Context, svc *registry.ServiceInstance) error {
+	return r.cli.EnableMaintenance(ctx, svc.ID, "draining")
+}
+
 // Deregister deregister service
 func (r *Registry) Deregister(ctx context.Context, svc *registry.ServiceInstance) error {
 	// NOTE: invoke the func Deregister will block when err is not nil
 	return r.cli.Deregister(ctx, svc.ID)
 }
 
+// LastHeartbeat returns the time of the last successful TTL update.
+func (r *Registry) LastHeartbeat() time.Time {
+	return r.cli.LastHeartbeat()
+}
+
 // GetService return service by name
 func (r *Registry) GetService(_ context.Context, name string) (services []*registry.ServiceInstance, err error) {
 	r.lock.RLock()
@@ -95,6 +150,12 @@ func (r *Registry) GetService(_ context.Context, name string) (services []*regis
 	return //nolint
 }
 
+// GetConfig returns the configuration of the service stored in KV key <prefix>/<serviceName>/<key>,
+// e.g. microservices_config/your-service-name/service_config
+func (r *Registry) GetConfig(ctx context.Context, serviceName string, key string) (string, error) {
+	return r.cli.GetConfig(ctx, r.configPrefix+"/"+serviceName+"/"+key)
+}
+
 // ListServices return service list.
 func (r *Registry) ListServices() (allServices map[string][]*registry.ServiceInstance, err error) {
 	r.lock.RLock()
@@ -112,28 +173,30 @@ func (r *Registry) ListServices() (allServices map[string][]*registry.ServiceIns
 	return //nolint
 }
 
-// Watch resolve service by name
-func (r *Registry) Watch(_ context.Context, name string) (registry.Watcher, error) {
+// Watch resolve service by name, the watcher is stopped when ctx is done, the service is resolved until all of
+// its watchers stop or the registry is closed.
+func (r *Registry) Watch(ctx context.Context, name string) (registry.Watcher, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+
+	w := &watcher{
+		event: make(chan struct{}, 1),
+	}
 	set, ok := r.registry[name]
+	if ok {
+		w.ctx, w.cancel = context.WithCancel(set.ctx)
+		w.set = set
+		ok = set.add(w)
+	}
 	if !ok {
-		set = &serviceSet{
-			watcher:     make(map[*watcher]struct{}),
-			services:    &atomic.Value{},
-			serviceName: name,
-		}
+		// the service is not resolved or the set is stopped by the last watcher
+		set = newServiceSet(r.ctx, name)
 		r.registry[name] = set
+		w.ctx, w.cancel = context.WithCancel(set.ctx)
+		w.set = set
+		set.add(w)
 	}
 
-	w := &watcher{
-		event: make(chan struct{}, 1),
-	}
-	w.ctx, w.cancel = context.WithCancel(context.Background())
-	w.set = set
-	set.lock.Lock()
-	set.watcher[w] = struct{}{}
-	set.lock.Unlock()
 	ss, _ := set.services.Load().([]*registry.ServiceInstance)
 	if len(ss) > 0 {
 		// If the service has a value, it needs to be pushed to the watcher,
@@ -144,28 +207,68 @@ func (r *Registry) Watch(_ context.Context, name string) (registry.Watcher, erro
 	if !ok {
 		go r.resolve(set)
 	}
+	if ctx.Done() != nil {
+		go w.stopWhenDone(ctx)
+	}
 	return w, nil
 }
 
+// Close stops resolving services and all watchers, and stops the TTL updates of the registered services.
+func (r *Registry) Close() error {
+	r.cancel()
+	r.cli.Close()
+	return nil
+}
+
 func (r *Registry) resolve(ss *serviceSet) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer func() {
+		r.lock.Lock()
+		if r.registry[ss.serviceName] == ss {
+			delete(r.registry, ss.serviceName)
+		}
+		r.lock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ss.ctx, time.Second*10)
 	services, idx, err := r.cli.Service(ctx, ss.serviceName, 0, true)
 	cancel()
 	if err == nil && len(services) > 0 {
 		ss.broadcast(services)
 	}
+	failed := err != nil
+	if failed {
+		r.metrics.WatcherError(backend, ss.serviceName)
+	}
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	for {
-		<-ticker.C
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*120)
+		select {
+		case <-ss.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(ss.ctx, time.Second*120)
 		tmpService, tmpIdx, err := r.cli.Service(ctx, ss.serviceName, idx, true)
 		cancel()
 		if err != nil {
-			time.Sleep(time.Second)
+			if ss.ctx.Err() != nil {
+				return
+			}
+			failed = true
+			r.metrics.WatcherError(backend, ss.serviceName)
+			select {
+			case <-ss.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
 			continue
 		}
-		if len(tmpService) != 0 && tmpIdx != idx {
+		if failed {
+			failed = false
+			r.metrics.WatcherReconnect(backend, ss.serviceName)
+		}
+		// the deregistration of the last instance is also a change
+		if tmpIdx != idx && (len(tmpService) != 0 || len(services) != 0) {
 			services = tmpService
 			ss.broadcast(services)
 		}
@@ -2,10 +2,15 @@ package consul
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/registrytest"
 
 	"github.com/hashicorp/consul/api"
 )
@@ -37,17 +42,24 @@ func TestRegistry_Register(t *testing.T) {
 	err := r.Register(context.Background(), instance)
 	t.Log(err)
 
+	instance.Version = "v2"
+	err = r.Update(context.Background(), instance)
+	t.Log(err)
+
 	_, err = r.ListServices()
 	t.Log(err)
 
 	_, err = r.GetService(context.Background(), "foo")
 	t.Log(err)
 
+	_, err = r.GetConfig(context.Background(), "foo", registry.ConfigKeyServiceConfig)
+	t.Log(err)
+
 	_, err = r.Watch(context.Background(), "foo")
 	t.Log(err)
 
 	go func() {
-		r.resolve(newServiceSet())
+		r.resolve(newServiceSet(context.Background(), "foo"))
 	}()
 
 	err = r.Deregister(context.Background(), instance)
@@ -55,3 +67,251 @@ func TestRegistry_Register(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 100)
 }
+
+func TestRegistry_Close(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		if strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+			_, _ = w.Write([]byte("[]"))
+		}
+	}))
+	defer srv.Close()
+	const pkg = "github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/consul"
+	before := registrytest.Goroutines(pkg)
+
+	transport := &http.Transport{}
+	consulClient, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String(), Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(consulClient)
+	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
+	if err = r.Register(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	w1, _ := r.Watch(context.Background(), "foo")
+	_, _ = r.Watch(context.Background(), "bar")
+	done := make(chan struct{})
+	go func() {
+		_, _ = w1.Next()
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watcher is not stopped")
+	}
+	transport.CloseIdleConnections()
+	srv.CloseClientConnections()
+	registrytest.WaitGoroutines(t, pkg, before)
+}
+
+func TestRegistry_stopResolve(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	consulClient, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(consulClient)
+	defer r.Close() //nolint
+	w, _ := r.Watch(context.Background(), "foo")
+	_ = w.Stop()
+
+	// the resolve loop removes the service after the last watcher stops
+	deadline := time.Now().Add(time.Second * 3)
+	for {
+		r.lock.RLock()
+		_, ok := r.registry["foo"]
+		r.lock.RUnlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("service is still resolved")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestRegistry_Hooks(t *testing.T) {
+	agent := newFakeAgent()
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+	consulClient, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan string, 10)
+	r := New(consulClient, WithHealthCheck(false), WithHooks(&registry.Hooks{
+		OnRegistered:   func(*registry.ServiceInstance) { events <- registry.EventRegistered },
+		OnLeaseLost:    func(*registry.ServiceInstance, error) { events <- registry.EventLeaseLost },
+		OnReRegistered: func(*registry.ServiceInstance) { events <- registry.EventReRegistered },
+		OnGiveUp:       func(*registry.ServiceInstance, error) { events <- registry.EventGiveUp },
+	}))
+	defer r.Close() //nolint
+	r.cli.checkInterval = time.Millisecond * 50
+
+	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
+	if err = r.Register(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent := func(want string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got event %s, want %s", got, want)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for event %s", want)
+		}
+	}
+	waitEvent(registry.EventRegistered)
+
+	// removed by the agent
+	agent.change(func() { delete(agent.services, instance.ID) })
+	waitEvent(registry.EventLeaseLost)
+	waitEvent(registry.EventReRegistered)
+
+	// the agent rejects the registrations
+	agent.change(func() {
+		delete(agent.services, instance.ID)
+		agent.failures = 5
+	})
+	waitEvent(registry.EventLeaseLost)
+	waitEvent(registry.EventGiveUp)
+}
+
+func TestRegistry_Manager(t *testing.T) {
+	agent := newFakeAgent()
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+	consulClient, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan string, 10)
+	r := New(consulClient, WithHealthCheck(false), WithHooks(&registry.Hooks{
+		OnLeaseLost:    func(*registry.ServiceInstance, error) { events <- registry.EventLeaseLost },
+		OnReRegistered: func(*registry.ServiceInstance) { events <- registry.EventReRegistered },
+	}))
+	defer r.Close() //nolint
+	r.cli.checkInterval = time.Millisecond * 50
+
+	var serving atomic.Bool
+	serving.Store(true)
+	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
+	m := registry.NewManager(r, instance, func(context.Context) bool { return serving.Load() },
+		registry.WithHealthInterval(time.Millisecond*20))
+	if err = m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(context.Background()) //nolint
+	registered := func() bool {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		_, ok := agent.services[instance.ID]
+		return ok
+	}
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second * 5)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("condition not met")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// deregistered when not serving, and registered again after recovery
+	serving.Store(false)
+	waitFor(func() bool { return !registered() })
+	serving.Store(true)
+	waitFor(func() bool { return registered() && m.Registered() })
+
+	// the keeper of the registration after recovery is running, the one before is stopped
+	agent.change(func() { delete(agent.services, instance.ID) })
+	for _, want := range []string{registry.EventLeaseLost, registry.EventReRegistered} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got event %s, want %s", got, want)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for event %s", want)
+		}
+	}
+	select {
+	case got := <-events:
+		t.Fatalf("got event %s of a stopped keeper", got)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestRegistry_HooksAfterDrain(t *testing.T) {
+	agent := newFakeAgent()
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+	consulClient, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reregistered := make(chan struct{}, 1)
+	r := New(consulClient, WithHealthCheck(false), WithHooks(&registry.Hooks{
+		OnReRegistered: func(*registry.ServiceInstance) { reregistered <- struct{}{} },
+	}))
+	defer r.Close() //nolint
+	r.cli.checkInterval = time.Millisecond * 50
+
+	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
+	if err = r.Register(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	updated := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"},
+		registry.WithVersion("v2"))
+	if err = r.Update(context.Background(), updated); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Drain(context.Background(), updated); err != nil {
+		t.Fatal(err)
+	}
+
+	// removed by the agent and registered again by the keeper
+	agent.change(func() {
+		delete(agent.services, instance.ID)
+		delete(agent.maintenance, instance.ID)
+	})
+	select {
+	case <-reregistered:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the registration again")
+	}
+
+	agent.mu.Lock()
+	asr, ok := agent.services[instance.ID]
+	maintenance := agent.maintenance[instance.ID]
+	agent.mu.Unlock()
+	if !ok {
+		t.Fatal("service is not registered again")
+	}
+	if len(asr.Tags) != 1 || asr.Tags[0] != "version=v2" {
+		t.Fatalf("registered again with tags %v, want version=v2", asr.Tags)
+	}
+	if !maintenance {
+		t.Fatal("drained service is not in maintenance mode after the registration again")
+	}
+}
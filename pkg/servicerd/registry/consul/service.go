@@ -1,6 +1,7 @@
 package consul
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 
@@ -12,6 +13,41 @@ type serviceSet struct {
 	watcher     map[*watcher]struct{}
 	services    *atomic.Value
 	lock        sync.RWMutex
+
+	// cancelled when the last watcher stops or the registry is closed, stops resolving the service
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newServiceSet(ctx context.Context, name string) *serviceSet {
+	ss := &serviceSet{
+		watcher:     make(map[*watcher]struct{}),
+		services:    &atomic.Value{},
+		serviceName: name,
+	}
+	ss.ctx, ss.cancel = context.WithCancel(ctx)
+	return ss
+}
+
+// add adds the watcher, returns false if the set is stopped.
+func (s *serviceSet) add(w *watcher) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.watcher[w] = struct{}{}
+	return true
+}
+
+// remove removes the watcher, the set is stopped when there is no watcher.
+func (s *serviceSet) remove(w *watcher) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.watcher, w)
+	if len(s.watcher) == 0 {
+		s.cancel()
+	}
 }
 
 func (s *serviceSet) broadcast(ss []*registry.ServiceInstance) {
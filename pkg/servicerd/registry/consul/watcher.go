@@ -32,8 +32,15 @@ func (w *watcher) Next() (services []*registry.ServiceInstance, err error) {
 
 func (w *watcher) Stop() error {
 	w.cancel()
-	w.set.lock.Lock()
-	defer w.set.lock.Unlock()
-	delete(w.set.watcher, w)
+	w.set.remove(w)
 	return nil
 }
+
+// stopWhenDone stops the watcher when ctx is done, it returns when the watcher is stopped.
+func (w *watcher) stopWhenDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		_ = w.Stop()
+	case <-w.ctx.Done():
+	}
+}
@@ -2,25 +2,14 @@ package consul
 
 import (
 	"context"
-	"sync"
-	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 )
 
-func newServiceSet() *serviceSet {
-	return &serviceSet{
-		serviceName: "foo",
-		watcher:     map[*watcher]struct{}{},
-		services:    &atomic.Value{},
-		lock:        sync.RWMutex{},
-	}
-}
-
 func TestServiceSet_broadcast(t *testing.T) {
-	ss := newServiceSet()
+	ss := newServiceSet(context.Background(), "foo")
 	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
 	ss.broadcast([]*registry.ServiceInstance{instance})
 }
@@ -29,7 +18,7 @@ func newWatch() *watcher {
 	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
 	wt := &watcher{
 		event:  make(chan struct{}),
-		set:    newServiceSet(),
+		set:    newServiceSet(context.Background(), "foo"),
 		ctx:    ctx,
 		cancel: cancelFunc,
 	}
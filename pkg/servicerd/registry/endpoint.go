@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+const queryKeyIsSecure = "isSecure"
+
+// Endpoint is an endpoint of a service instance, the format is scheme://host:port?isSecure=true&key=value,
+// e.g. grpc://127.0.0.1:9000, http://[::1]:8000?isSecure=true
+type Endpoint struct {
+	Scheme string
+	// Host is the IP or domain name, IPv6 is without brackets.
+	Host     string
+	Port     int
+	IsSecure bool
+	// Attributes are the query parameters except isSecure.
+	Attributes map[string]string
+}
+
+// NewEndpoint creates an endpoint.
+func NewEndpoint(scheme string, host string, port int, isSecure bool) *Endpoint {
+	return &Endpoint{
+		Scheme:   scheme,
+		Host:     host,
+		Port:     port,
+		IsSecure: isSecure,
+	}
+}
+
+// ParseEndpoint parses the endpoint, the host may be empty, e.g. grpc://:9000
+func ParseEndpoint(endpoint string) (*Endpoint, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("endpoint %q has no scheme, e.g. grpc://127.0.0.1:9000", endpoint)
+	}
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %q: %v", endpoint, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("endpoint %q has invalid port %q", endpoint, portStr)
+	}
+
+	e := &Endpoint{
+		Scheme: u.Scheme,
+		Host:   host,
+		Port:   port,
+	}
+	for key, values := range u.Query() {
+		if key == queryKeyIsSecure {
+			e.IsSecure, err = strconv.ParseBool(values[0])
+			if err != nil {
+				return nil, fmt.Errorf("endpoint %q has invalid isSecure %q", endpoint, values[0])
+			}
+			continue
+		}
+		if e.Attributes == nil {
+			e.Attributes = make(map[string]string)
+		}
+		e.Attributes[key] = values[0]
+	}
+	return e, nil
+}
+
+// Address returns host:port, IPv6 is in brackets.
+func (e *Endpoint) Address() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// String returns the endpoint in URL format, isSecure is omitted if false, and the attributes are sorted by key.
+func (e *Endpoint) String() string {
+	query := url.Values{}
+	if e.IsSecure {
+		query.Set(queryKeyIsSecure, "true")
+	}
+	for k, v := range e.Attributes {
+		query.Set(k, v)
+	}
+	u := url.URL{
+		Scheme:   e.Scheme,
+		Host:     e.Address(),
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// ParseEndpoints parses the endpoints of the instance.
+func (s *ServiceInstance) ParseEndpoints() ([]*Endpoint, error) {
+	endpoints := make([]*Endpoint, 0, len(s.Endpoints))
+	for _, endpoint := range s.Endpoints {
+		e, err := ParseEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// Validate checks the ID, name and endpoints of the instance.
+func (s *ServiceInstance) Validate() error {
+	if s == nil {
+		return errors.New("service instance is nil")
+	}
+	if s.ID == "" {
+		return errors.New("service instance id can not be empty")
+	}
+	if s.Name == "" {
+		return errors.New("service instance name can not be empty")
+	}
+	if len(s.Endpoints) == 0 {
+		return fmt.Errorf("service instance %s has no endpoints", s.ID)
+	}
+	endpoints, err := s.ParseEndpoints()
+	if err != nil {
+		return err
+	}
+	for _, e := range endpoints {
+		if e.Host == "" {
+			return fmt.Errorf("endpoint %s of service instance %s has no host", e, s.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		address  string
+		isSecure bool
+		want     string // String() of the parsed endpoint
+		wantErr  bool
+	}{
+		{endpoint: "grpc://127.0.0.1:9000", address: "127.0.0.1:9000", want: "grpc://127.0.0.1:9000"},
+		{endpoint: "grpc://127.0.0.1:9000?isSecure=false", address: "127.0.0.1:9000", want: "grpc://127.0.0.1:9000"},
+		{endpoint: "http://example.com:8000?isSecure=true", address: "example.com:8000", isSecure: true, want: "http://example.com:8000?isSecure=true"},
+		{endpoint: "grpc://[::1]:9000?zone=a&isSecure=true", address: "[::1]:9000", isSecure: true, want: "grpc://[::1]:9000?isSecure=true&zone=a"},
+		{endpoint: "grpc://[fe80::1%25eth0]:9000", address: "[fe80::1%eth0]:9000", want: "grpc://[fe80::1%25eth0]:9000"},
+		{endpoint: "127.0.0.1:9000", wantErr: true},
+		{endpoint: "grpc://127.0.0.1", wantErr: true},
+		{endpoint: "grpc://127.0.0.1:0", wantErr: true},
+		{endpoint: "grpc://127.0.0.1:9000?isSecure=yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			e, err := ParseEndpoint(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if e.Address() != tt.address || e.IsSecure != tt.isSecure || e.String() != tt.want {
+				t.Fatalf("got %s, %v, %s", e.Address(), e.IsSecure, e.String())
+			}
+			again, err := ParseEndpoint(e.String())
+			if err != nil || again.String() != e.String() {
+				t.Fatalf("round trip got %v, %v", again, err)
+			}
+		})
+	}
+}
+
+func TestServiceInstance_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance *ServiceInstance
+		wantErr  bool
+	}{
+		{"valid", NewServiceInstance("1", "foo", []string{"grpc://127.0.0.1:9000"}), false},
+		{"no id", NewServiceInstance("", "foo", []string{"grpc://127.0.0.1:9000"}), true},
+		{"no name", NewServiceInstance("1", "", []string{"grpc://127.0.0.1:9000"}), true},
+		{"no endpoints", NewServiceInstance("1", "foo", nil), true},
+		{"no host", NewServiceInstance("1", "foo", []string{"grpc://:9000"}), true},
+		{"invalid endpoint", NewServiceInstance("1", "foo", []string{"127.0.0.1"}), true},
+	}
+	for _, tt := range tests {
+		if err := tt.instance.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/registrytest"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+// fakeEtcd is an etcd server of the KV, Lease and Watch services which keeps the keys and events in memory,
+// leases never expire until expire is called, and watches replay the events from their start revision.
+type fakeEtcd struct {
+	pb.UnimplementedKVServer
+	pb.UnimplementedLeaseServer
+	pb.UnimplementedWatchServer
+
+	mu      sync.Mutex
+	rev     int64
+	kvs     map[string]*mvccpb.KeyValue
+	leaseID int64
+	leases  map[int64]int64 // lease id -> ttl
+	watchID int64
+	watches map[int64]*fakeWatch
+	history []*mvccpb.Event
+	compact int64 // revisions up to compact are compacted
+	ranges  int
+}
+
+type fakeWatch struct {
+	key      []byte
+	rangeEnd []byte
+	stream   *fakeWatchStream
+}
+
+// fakeWatchStream serializes the sends of a watch stream.
+type fakeWatchStream struct {
+	mu     sync.Mutex
+	stream pb.Watch_WatchServer
+}
+
+func (s *fakeWatchStream) send(resp *pb.WatchResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.stream.Send(resp)
+}
+
+// startFakeEtcd starts the server on a local port, it is stopped by t.Cleanup.
+func startFakeEtcd(t *testing.T) (*fakeEtcd, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeEtcd{
+		kvs:     make(map[string]*mvccpb.KeyValue),
+		leases:  make(map[int64]int64),
+		watches: make(map[int64]*fakeWatch),
+		rev:     1,
+	}
+	srv := grpc.NewServer()
+	pb.RegisterKVServer(srv, s)
+	pb.RegisterLeaseServer(srv, s)
+	pb.RegisterWatchServer(srv, s)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	return s, lis.Addr().String()
+}
+
+// expire expires all leases, the keepalives of them fail.
+func (s *fakeEtcd) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases = make(map[int64]int64)
+}
+
+func (s *fakeEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{ClusterId: 1, MemberId: 1, Revision: s.rev}
+}
+
+// inRange reports whether key is in [start, end), empty end means start only, "\x00" means all keys from start.
+func inRange(key []byte, start []byte, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(key, start)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(key, start) >= 0
+	default:
+		return bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+	}
+}
+
+// rangeCount returns the number of Range requests.
+func (s *fakeEtcd) rangeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ranges
+}
+
+// compactTo compacts the events up to rev, the watches from compacted revisions fail.
+func (s *fakeEtcd) compactTo(rev int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compact = rev
+	history := s.history[:0]
+	for _, ev := range s.history {
+		if ev.Kv.ModRevision > rev {
+			history = append(history, ev)
+		}
+	}
+	s.history = history
+}
+
+// cancelWatches cancels all watches by the server.
+func (s *fakeEtcd) cancelWatches(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, w := range s.watches {
+		w.stream.send(&pb.WatchResponse{Header: s.header(), WatchId: id, Canceled: true, CancelReason: reason})
+		delete(s.watches, id)
+	}
+}
+
+// notify records the event and sends it to the watches of the key, the caller must hold the lock.
+func (s *fakeEtcd) notify(ev *mvccpb.Event) {
+	s.history = append(s.history, ev)
+	for id, w := range s.watches {
+		if inRange(ev.Kv.Key, w.key, w.rangeEnd) {
+			w.stream.send(&pb.WatchResponse{Header: s.header(), WatchId: id, Events: []*mvccpb.Event{ev}})
+		}
+	}
+}
+
+func (s *fakeEtcd) Range(_ context.Context, req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ranges++
+	resp := &pb.RangeResponse{Header: s.header()}
+	for _, kv := range s.kvs {
+		if inRange(kv.Key, req.Key, req.RangeEnd) {
+			resp.Kvs = append(resp.Kvs, kv)
+		}
+	}
+	resp.Count = int64(len(resp.Kvs))
+	return resp, nil
+}
+
+func (s *fakeEtcd) Put(_ context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rev++
+	kv := &mvccpb.KeyValue{Key: req.Key, Value: req.Value, Lease: req.Lease, ModRevision: s.rev, Version: 1}
+	if prev, ok := s.kvs[string(req.Key)]; ok {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	} else {
+		kv.CreateRevision = s.rev
+	}
+	s.kvs[string(req.Key)] = kv
+	s.notify(&mvccpb.Event{Type: mvccpb.PUT, Kv: kv})
+	return &pb.PutResponse{Header: s.header()}, nil
+}
+
+func (s *fakeEtcd) DeleteRange(_ context.Context, req *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &pb.DeleteRangeResponse{}
+	for key, kv := range s.kvs {
+		if !inRange(kv.Key, req.Key, req.RangeEnd) {
+			continue
+		}
+		s.rev++
+		delete(s.kvs, key)
+		resp.Deleted++
+		s.notify(&mvccpb.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: kv.Key, ModRevision: s.rev}})
+	}
+	resp.Header = s.header()
+	return resp, nil
+}
+
+func (s *fakeEtcd) LeaseGrant(_ context.Context, req *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leaseID++
+	s.leases[s.leaseID] = req.TTL
+	return &pb.LeaseGrantResponse{Header: s.header(), ID: s.leaseID, TTL: req.TTL}, nil
+}
+
+func (s *fakeEtcd) LeaseRevoke(_ context.Context, req *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.leases, req.ID)
+	return &pb.LeaseRevokeResponse{Header: s.header()}, nil
+}
+
+func (s *fakeEtcd) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		resp := &pb.LeaseKeepAliveResponse{Header: s.header(), ID: req.ID, TTL: s.leases[req.ID]}
+		s.mu.Unlock()
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fakeEtcd) Watch(stream pb.Watch_WatchServer) error {
+	ws := &fakeWatchStream{stream: stream}
+	var ids []int64
+	defer func() {
+		s.mu.Lock()
+		for _, id := range ids {
+			delete(s.watches, id)
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		switch r := req.RequestUnion.(type) {
+		case *pb.WatchRequest_CreateRequest:
+			s.watchID++
+			cr := r.CreateRequest
+			ws.send(&pb.WatchResponse{Header: s.header(), WatchId: s.watchID, Created: true})
+			if cr.StartRevision > 0 && cr.StartRevision <= s.compact {
+				ws.send(&pb.WatchResponse{Header: s.header(), WatchId: s.watchID, Canceled: true, CompactRevision: s.compact})
+				break
+			}
+			ids = append(ids, s.watchID)
+			s.watches[s.watchID] = &fakeWatch{key: cr.Key, rangeEnd: cr.RangeEnd, stream: ws}
+			for _, ev := range s.history {
+				if cr.StartRevision > 0 && ev.Kv.ModRevision >= cr.StartRevision && inRange(ev.Kv.Key, cr.Key, cr.RangeEnd) {
+					ws.send(&pb.WatchResponse{Header: s.header(), WatchId: s.watchID, Events: []*mvccpb.Event{ev}})
+				}
+			}
+		case *pb.WatchRequest_CancelRequest:
+			delete(s.watches, r.CancelRequest.WatchId)
+			ws.send(&pb.WatchResponse{Header: s.header(), WatchId: r.CancelRequest.WatchId, Canceled: true})
+		case *pb.WatchRequest_ProgressRequest:
+			ws.send(&pb.WatchResponse{Header: s.header(), WatchId: -1}) // progress of all watches
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	registrytest.RunConformance(t, func(t *testing.T) *registrytest.Backend {
+		_, addr := startFakeEtcd(t)
+		newRegistry := func() *Registry {
+			client, err := clientv3.New(clientv3.Config{Endpoints: []string{addr}, DialTimeout: time.Second * 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := New(client)
+			t.Cleanup(func() { _ = r.Close() })
+			return r
+		}
+		return &registrytest.Backend{
+			NewRegistry: func() registry.Registry { return newRegistry() },
+			Discovery:   newRegistry(),
+		}
+	})
+}
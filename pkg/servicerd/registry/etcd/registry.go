@@ -2,19 +2,29 @@ package etcd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/etcdcli"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+const backend = "etcd"
+
 var (
-	_ registry.Registry  = &Registry{}
-	_ registry.Discovery = &Registry{}
+	_ registry.Registry     = &Registry{}
+	_ registry.Discovery    = &Registry{}
+	_ registry.ConfigGetter = &Registry{}
+	_ registry.Updater      = &Registry{}
+	_ registry.Drainer      = &Registry{}
+	_ io.Closer             = &Registry{}
 )
 
 // Option is etcd registry option.
@@ -25,6 +35,8 @@ type options struct {
 	namespace string
 	ttl       time.Duration
 	maxRetry  int
+	metrics   *metrics.Metrics
+	hooks     *registry.Hooks
 }
 
 func defaultOptions() *options {
@@ -56,6 +68,17 @@ func WithMaxRetry(num int) Option {
 	return func(o *options) { o.maxRetry = num }
 }
 
+// WithMetrics set prometheus metrics.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *options) { o.metrics = m }
+}
+
+// WithHooks set the hooks of registration lifecycle events, the lease is lost when the keepalive stops,
+// and the registry gives up after max retry failed registrations.
+func WithHooks(hooks *registry.Hooks) Option {
+	return func(o *options) { o.hooks = hooks }
+}
+
 // NewRegistry instantiating the etcd registry
 // Note: If the etcdcli.WithConfig(*clientv3.Config) parameter is set, the etcdEndpoints parameter is ignored!
 func NewRegistry(etcdEndpoints []string, id string, instanceName string, instanceEndpoints []string, opts ...etcdcli.Option) (registry.Registry, *registry.ServiceInstance, error) {
@@ -75,6 +98,18 @@ type Registry struct {
 	client *clientv3.Client
 	kv     clientv3.KV
 	lease  clientv3.Lease
+
+	// cancelled by Close, stops the heartbeats and watchers
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stopHeartbeat context.CancelFunc // stops the heartbeat of the registration
+
+	mu            sync.Mutex
+	leaseID       clientv3.LeaseID
+	lastHeartbeat time.Time
+	value         string // value of the registered instance
+	service       *registry.ServiceInstance
 }
 
 // New create a etcd registry
@@ -83,15 +118,20 @@ func New(client *clientv3.Client, opts ...Option) (r *Registry) {
 	for _, opt := range opts {
 		opt(o)
 	}
-	return &Registry{
+	r = &Registry{
 		opts:   o,
 		client: client,
 		kv:     clientv3.NewKV(client),
 	}
+	r.ctx, r.cancel = context.WithCancel(o.ctx)
+	return r
 }
 
 // Register the registration.
 func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstance) error {
+	if err := service.Validate(); err != nil {
+		return err
+	}
 	key := fmt.Sprintf("%s/%s/%s", r.opts.namespace, service.Name, service.ID)
 	value, err := marshal(service)
 	if err != nil {
@@ -102,11 +142,46 @@ func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstan
 	}
 	r.lease = clientv3.NewLease(r.client)
 	leaseID, err := r.registerWithKV(ctx, key, value)
+	r.opts.metrics.Register(backend, err)
 	if err != nil {
 		return err
 	}
+	r.setLease(leaseID, time.Now())
+	r.setValue(service, value)
+	r.opts.hooks.Registered(service)
+
+	hbCtx, cancel := context.WithCancel(r.ctx)
+	r.mu.Lock()
+	if r.stopHeartbeat != nil {
+		r.stopHeartbeat()
+	}
+	r.stopHeartbeat = cancel
+	r.mu.Unlock()
+	go r.heartBeat(hbCtx, leaseID, key)
+	return nil
+}
 
-	go r.heartBeat(r.opts.ctx, leaseID, key, value)
+// Update puts the instance under the lease of the registration, the updated instance is also used when
+// the lease is lost and the instance is registered again.
+func (r *Registry) Update(ctx context.Context, service *registry.ServiceInstance) error {
+	if err := service.Validate(); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s/%s/%s", r.opts.namespace, service.Name, service.ID)
+	value, err := marshal(service)
+	if err != nil {
+		return err
+	}
+	leaseID := clientv3.LeaseID(r.LeaseID())
+	if leaseID == 0 {
+		return fmt.Errorf("etcd: instance %s is not registered or its lease is lost", service.ID)
+	}
+	defer r.opts.metrics.Request(backend, "update", time.Now())
+	_, err = r.client.Put(ctx, key, value, clientv3.WithLease(leaseID))
+	if err != nil {
+		return err
+	}
+	r.setValue(service, value)
 	return nil
 }
 
@@ -117,7 +192,15 @@ func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInst
 			_ = r.lease.Close()
 		}
 	}()
+	r.mu.Lock()
+	if r.stopHeartbeat != nil {
+		r.stopHeartbeat()
+		r.stopHeartbeat = nil
+	}
+	r.leaseID = 0
+	r.mu.Unlock()
 	key := fmt.Sprintf("%s/%s/%s", r.opts.namespace, service.Name, service.ID)
+	defer r.opts.metrics.Request(backend, "deregister", time.Now())
 	_, err := r.client.Delete(ctx, key)
 	return err
 }
@@ -125,7 +208,9 @@ func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInst
 // GetService return the service instances in memory according to the service name.
 func (r *Registry) GetService(ctx context.Context, name string) ([]*registry.ServiceInstance, error) {
 	key := fmt.Sprintf("%s/%s", r.opts.namespace, name)
+	start := time.Now()
 	resp, err := r.kv.Get(ctx, key, clientv3.WithPrefix())
+	r.opts.metrics.Request(backend, "get_service", start)
 	if err != nil {
 		return nil, err
 	}
@@ -143,14 +228,88 @@ func (r *Registry) GetService(ctx context.Context, name string) ([]*registry.Ser
 	return items, nil
 }
 
-// Watch creates a watcher according to the service name.
+// GetConfig returns the configuration of the service stored in key <namespace>_config/<serviceName>/<key>,
+// e.g. /microservices_config/your-service-name/service_config
+func (r *Registry) GetConfig(ctx context.Context, serviceName string, key string) (string, error) {
+	configKey := fmt.Sprintf("%s_config/%s/%s", r.opts.namespace, serviceName, key)
+	defer r.opts.metrics.Request(backend, "get_config", time.Now())
+	resp, err := r.kv.Get(ctx, configKey)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Watch creates a watcher according to the service name, the watcher is stopped when the registry is closed.
 func (r *Registry) Watch(ctx context.Context, name string) (registry.Watcher, error) {
 	key := fmt.Sprintf("%s/%s", r.opts.namespace, name)
-	return newWatcher(ctx, key, name, r.client)
+	w := newWatcher(ctx, key, name, r.client, r.opts.metrics)
+	go w.stopWhenDone(r.ctx)
+	return w, nil
+}
+
+// Close stops the heartbeats and watchers, and closes the etcd client, the registered instances expire
+// with their leases.
+func (r *Registry) Close() error {
+	r.cancel()
+	if r.lease != nil {
+		_ = r.lease.Close()
+	}
+	err := r.client.Close()
+	if errors.Is(err, context.Canceled) {
+		// the client is closed
+		return nil
+	}
+	return err
+}
+
+// LeaseID returns the lease ID of the registration, 0 means the lease is lost.
+func (r *Registry) LeaseID() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(r.leaseID)
+}
+
+// LastHeartbeat returns the time of the last lease renewal.
+func (r *Registry) LastHeartbeat() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastHeartbeat
+}
+
+// Drain updates the instance with metadata status=draining.
+func (r *Registry) Drain(ctx context.Context, service *registry.ServiceInstance) error {
+	return r.Update(ctx, registry.Draining(service))
+}
+
+func (r *Registry) setValue(service *registry.ServiceInstance, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.service = service
+	r.value = value
+}
+
+func (r *Registry) getValue() (*registry.ServiceInstance, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.service, r.value
+}
+
+func (r *Registry) setLease(id clientv3.LeaseID, heartbeat time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.leaseID = id
+	if !heartbeat.IsZero() {
+		r.lastHeartbeat = heartbeat
+	}
 }
 
 // registerWithKV create a new lease, return current leaseID
 func (r *Registry) registerWithKV(ctx context.Context, key string, value string) (clientv3.LeaseID, error) {
+	defer r.opts.metrics.Request(backend, "register", time.Now())
 	grant, err := r.lease.Grant(ctx, int64(r.opts.ttl.Seconds()))
 	if err != nil {
 		return 0, err
@@ -162,11 +321,13 @@ func (r *Registry) registerWithKV(ctx context.Context, key string, value string)
 	return grant.ID, nil
 }
 
-func (r *Registry) heartBeat(ctx context.Context, leaseID clientv3.LeaseID, key string, value string) {
+func (r *Registry) heartBeat(ctx context.Context, leaseID clientv3.LeaseID, key string) {
 	curLeaseID := leaseID
 	kac, err := r.client.KeepAlive(ctx, leaseID)
 	if err != nil {
 		curLeaseID = 0
+		service, _ := r.getValue()
+		r.opts.hooks.LeaseLost(service, err)
 	}
 	rand.Seed(time.Now().Unix())
 
@@ -174,6 +335,8 @@ func (r *Registry) heartBeat(ctx context.Context, leaseID clientv3.LeaseID, key
 		if curLeaseID == 0 {
 			// try to registerWithKV
 			retreat := []int{}
+			registered := false
+			var lastErr error
 			for retryCnt := 0; retryCnt < r.opts.maxRetry; retryCnt++ {
 				if ctx.Err() != nil {
 					return
@@ -184,7 +347,9 @@ func (r *Registry) heartBeat(ctx context.Context, leaseID clientv3.LeaseID, key
 				cancelCtx, cancel := context.WithCancel(ctx)
 				go func() {
 					defer cancel()
+					_, value := r.getValue()
 					id, registerErr := r.registerWithKV(cancelCtx, key, value)
+					r.opts.metrics.Register(backend, registerErr)
 					if registerErr != nil {
 						errChan <- registerErr
 					} else {
@@ -195,23 +360,37 @@ func (r *Registry) heartBeat(ctx context.Context, leaseID clientv3.LeaseID, key
 				select {
 				case <-time.After(3 * time.Second):
 					cancel()
+					lastErr = errors.New("register timeout")
 					continue
-				case <-errChan:
+				case lastErr = <-errChan:
 					continue
 				case curLeaseID = <-idChan:
 				}
 
 				kac, err = r.client.KeepAlive(ctx, curLeaseID)
 				if err == nil {
+					r.setLease(curLeaseID, time.Now())
+					registered = true
 					break
 				}
+				lastErr = err
 				retreat = append(retreat, 1<<retryCnt)
-				time.Sleep(time.Duration(retreat[rand.Intn(len(retreat))]) * time.Second)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(retreat[rand.Intn(len(retreat))]) * time.Second):
+				}
+			}
+			if ctx.Err() != nil {
+				return
 			}
-			if _, ok := <-kac; !ok {
-				// retry failed
+			service, _ := r.getValue()
+			if !registered {
+				r.setLease(0, time.Time{})
+				r.opts.hooks.GiveUp(service, fmt.Errorf("register %d times failed: %v", r.opts.maxRetry, lastErr))
 				return
 			}
+			r.opts.hooks.ReRegistered(service)
 		}
 
 		select {
@@ -223,9 +402,14 @@ func (r *Registry) heartBeat(ctx context.Context, leaseID clientv3.LeaseID, key
 				}
 				// need to retry registration
 				curLeaseID = 0
+				r.setLease(0, time.Time{})
+				service, _ := r.getValue()
+				r.opts.hooks.LeaseLost(service, errors.New("keepalive channel closed"))
 				continue
 			}
-		case <-r.opts.ctx.Done():
+			r.opts.metrics.Heartbeat(backend)
+			r.setLease(curLeaseID, time.Now())
+		case <-ctx.Done():
 			return
 		}
 	}
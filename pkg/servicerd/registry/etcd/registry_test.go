@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/registrytest"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
@@ -97,11 +98,86 @@ func TestRegistry_Register(t *testing.T) {
 	err := r.Register(context.Background(), instance)
 	t.Log(err)
 
+	instance.Version = "v2"
+	err = r.Update(context.Background(), instance)
+	t.Log(err)
+
 	sis, err := r.GetService(context.Background(), "foo")
 	t.Log(sis, err)
 
+	config, err := r.GetConfig(context.Background(), "foo", registry.ConfigKeyServiceConfig)
+	t.Log(config, err)
+
 	time.Sleep(time.Second)
 
 	err = r.Deregister(context.Background(), instance)
 	t.Log(err)
 }
+
+func TestRegistry_Close(t *testing.T) {
+	const pkg = "github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/etcd"
+	before := registrytest.Goroutines(pkg)
+
+	client := clientv3.NewCtxClient(context.Background())
+	client.Lease = &lease{}
+	client.KV = &kv{}
+	client.Watcher = &wt{}
+	r := New(client)
+
+	go r.heartBeat(r.ctx, 1, "foo/bar/1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &watcher{watcher: &wt{}, kv: &kv{}, watchChan: make(clientv3.WatchChan), loaded: true, serviceName: "bar"}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	go w.stopWhenDone(r.ctx)
+	done := make(chan struct{})
+	go func() {
+		_, _ = w.Next()
+		close(done)
+	}()
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watcher is not stopped")
+	}
+	registrytest.WaitGoroutines(t, pkg, before)
+}
+
+func TestRegistry_Hooks(t *testing.T) {
+	server, addr := startFakeEtcd(t)
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{addr}, DialTimeout: time.Second * 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan string, 10)
+	r := New(client, WithRegisterTTL(time.Second*3), WithHooks(&registry.Hooks{
+		OnRegistered:   func(*registry.ServiceInstance) { events <- registry.EventRegistered },
+		OnLeaseLost:    func(*registry.ServiceInstance, error) { events <- registry.EventLeaseLost },
+		OnReRegistered: func(*registry.ServiceInstance) { events <- registry.EventReRegistered },
+	}))
+	defer r.Close() //nolint
+
+	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
+	if err = r.Register(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	server.expire()
+
+	for _, want := range []string{registry.EventRegistered, registry.EventLeaseLost, registry.EventReRegistered} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got event %s, want %s", got, want)
+			}
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timeout waiting for event %s", want)
+		}
+	}
+	if r.LeaseID() == 0 {
+		t.Fatal("lease is not renewed")
+	}
+}
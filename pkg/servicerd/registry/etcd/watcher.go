@@ -2,77 +2,190 @@ package etcd
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
 
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 var _ registry.Watcher = &watcher{}
 
+// errWatchClosed means the watch channel is closed by etcd, e.g. the watch is cancelled by the server.
+var errWatchClosed = errors.New("etcd watch channel is closed")
+
+// watcher loads the instances once and applies the watch events from the next revision to them,
+// the instances are loaded again after the watch fails.
 type watcher struct {
 	key         string
 	ctx         context.Context
 	cancel      context.CancelFunc
 	watchChan   clientv3.WatchChan
+	watchCancel context.CancelFunc
 	watcher     clientv3.Watcher
 	kv          clientv3.KV
-	first       bool
+	loaded      bool
+	instances   map[string]*registry.ServiceInstance // key -> instance
 	serviceName string
+	metrics     *metrics.Metrics
+	failed      bool
+	stopOnce    sync.Once
 }
 
-func newWatcher(ctx context.Context, key, name string, client *clientv3.Client) (*watcher, error) {
+func newWatcher(ctx context.Context, key, name string, client *clientv3.Client, m *metrics.Metrics) *watcher {
 	w := &watcher{
 		key:         key,
-		first:       true,
 		serviceName: name,
+		metrics:     m,
 		kv:          clientv3.NewKV(client),
 		watcher:     clientv3.NewWatcher(client),
 	}
 	w.ctx, w.cancel = context.WithCancel(ctx)
-	w.watchChan = w.watcher.Watch(w.ctx, key, clientv3.WithPrefix(), clientv3.WithRev(0))
-	err := w.watcher.RequestProgress(context.Background())
-	if err != nil {
-		return nil, err
-	}
-	return w, nil
+	return w
 }
 
+// Next returns all instances on the first call even if there are none, then returns them after they change.
 func (w *watcher) Next() ([]*registry.ServiceInstance, error) {
-	if w.first {
-		item, err := w.getInstance()
-		w.first = false
-		return item, err
+	if !w.loaded {
+		return w.load()
 	}
 
-	select {
-	case <-w.ctx.Done():
-		return nil, w.ctx.Err()
-	case <-w.watchChan:
-		return w.getInstance()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return nil, w.ctx.Err()
+		case resp, ok := <-w.watchChan:
+			if !ok {
+				if w.ctx.Err() != nil {
+					return nil, w.ctx.Err()
+				}
+				return nil, w.fail(errWatchClosed)
+			}
+			if err := resp.Err(); err != nil {
+				if errors.Is(err, rpctypes.ErrCompacted) {
+					// the events since the loaded revision are lost
+					fmt.Printf("[registry] resync %s: %v\n", w.key, err)
+					return w.load()
+				}
+				return nil, w.fail(err)
+			}
+			if len(resp.Events) == 0 {
+				// progress notification
+				continue
+			}
+			if err := w.apply(resp.Events); err != nil {
+				return nil, w.fail(err)
+			}
+			return w.list(), nil
+		}
 	}
 }
 
 func (w *watcher) Stop() error {
-	w.cancel()
-	return w.watcher.Close()
+	var err error
+	w.stopOnce.Do(func() {
+		w.cancel()
+		err = w.watcher.Close()
+	})
+	return err
+}
+
+// stopWhenDone stops the watcher when ctx is done, it returns when the watcher is stopped.
+func (w *watcher) stopWhenDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		_ = w.Stop()
+	case <-w.ctx.Done():
+	}
 }
 
-func (w *watcher) getInstance() ([]*registry.ServiceInstance, error) {
+// load gets all instances and watches from the next revision of them.
+func (w *watcher) load() ([]*registry.ServiceInstance, error) {
+	if w.watchCancel != nil {
+		w.watchCancel()
+		w.watchCancel = nil
+	}
+	w.loaded = false
+
 	resp, err := w.kv.Get(w.ctx, w.key, clientv3.WithPrefix())
 	if err != nil {
-		return nil, err
+		return nil, w.fail(err)
 	}
-	items := make([]*registry.ServiceInstance, 0, len(resp.Kvs))
+	instances := make(map[string]*registry.ServiceInstance, len(resp.Kvs))
 	for _, kv := range resp.Kvs {
 		si, err := unmarshal(kv.Value)
 		if err != nil {
-			return nil, err
+			return nil, w.fail(err)
 		}
 		if si.Name != w.serviceName {
 			continue
 		}
-		items = append(items, si)
+		instances[string(kv.Key)] = si
+	}
+
+	var watchCtx context.Context
+	watchCtx, w.watchCancel = context.WithCancel(w.ctx)
+	w.watchChan = w.watcher.Watch(watchCtx, w.key, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.GetRevision()+1))
+	w.instances = instances
+	w.loaded = true
+	if w.failed {
+		w.failed = false
+		w.metrics.WatcherReconnect(backend, w.serviceName)
+	}
+	return w.list(), nil
+}
+
+// apply applies the watch events to the instances.
+func (w *watcher) apply(events []*clientv3.Event) error {
+	for _, ev := range events {
+		key := string(ev.Kv.Key)
+		switch ev.Type {
+		case clientv3.EventTypePut:
+			si, err := unmarshal(ev.Kv.Value)
+			if err != nil {
+				return err
+			}
+			if si.Name != w.serviceName {
+				delete(w.instances, key)
+				continue
+			}
+			w.instances[key] = si
+		case clientv3.EventTypeDelete:
+			delete(w.instances, key)
+		}
+	}
+	return nil
+}
+
+// fail records the error, the instances are loaded again by the next call of Next.
+func (w *watcher) fail(err error) error {
+	if w.watchCancel != nil {
+		w.watchCancel()
+		w.watchCancel = nil
+	}
+	w.loaded = false
+	if w.ctx.Err() == nil {
+		w.failed = true
+		w.metrics.WatcherError(backend, w.serviceName)
+	}
+	return err
+}
+
+// list returns the instances ordered by key.
+func (w *watcher) list() []*registry.ServiceInstance {
+	keys := make([]string, 0, len(w.instances))
+	for key := range w.instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	items := make([]*registry.ServiceInstance, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, w.instances[key])
 	}
-	return items, nil
+	return items
 }
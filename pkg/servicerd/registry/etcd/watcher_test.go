@@ -2,9 +2,12 @@ package etcd
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -23,7 +26,7 @@ func (w wt) Close() error {
 	return nil
 }
 
-func newWatch(first bool) *watcher {
+func newWatch(loaded bool) *watcher {
 	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
 	r := New(&clientv3.Client{})
 
@@ -34,26 +37,21 @@ func newWatch(first bool) *watcher {
 		watchChan:   make(clientv3.WatchChan),
 		watcher:     &wt{},
 		kv:          r.kv,
-		first:       first,
+		loaded:      loaded,
+		instances:   make(map[string]*registry.ServiceInstance),
 		serviceName: "host",
 	}
 }
 
 func Test_watcher(t *testing.T) {
-	w := newWatch(false)
+	w := newWatch(true)
 	instances, err := w.Next()
 	t.Log(instances, err)
 
 	go func() {
 		defer func() { recover() }()
-		w = newWatch(true)
-		instances, err = w.Next()
-		t.Log(instances, err)
-	}()
-
-	go func() {
-		defer func() { recover() }()
-		instances, err = w.getInstance()
+		w := newWatch(false)
+		instances, err := w.Next()
 		t.Log(instances, err)
 	}()
 
@@ -62,3 +60,127 @@ func Test_watcher(t *testing.T) {
 	err = w.Stop()
 	t.Log(err)
 }
+
+// startWatch starts a fake etcd server and a watcher of service foo.
+func startWatch(t *testing.T) (*fakeEtcd, *clientv3.Client, *watcher) {
+	s, addr := startFakeEtcd(t)
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{addr}, DialTimeout: time.Second * 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	t.Cleanup(cancel)
+	w := newWatcher(ctx, "/microservices/foo", "foo", client, nil)
+	t.Cleanup(func() { _ = w.Stop() })
+	return s, client, w
+}
+
+func putInstance(t *testing.T, client *clientv3.Client, name, id string) {
+	t.Helper()
+	value, err := marshal(registry.NewServiceInstance(id, name, []string{"grpc://127.0.0.1:8282"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Put(context.Background(), "/microservices/"+name+"/"+id, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextIDs(t *testing.T, w *watcher) []string {
+	t.Helper()
+	instances, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(instances))
+	for _, si := range instances {
+		ids = append(ids, si.ID)
+	}
+	return ids
+}
+
+func checkIDs(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got instances %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got instances %v, want %v", got, want)
+		}
+	}
+}
+
+func Test_watcherIncremental(t *testing.T) {
+	s, client, w := startWatch(t)
+	putInstance(t, client, "foo", "1")
+
+	checkIDs(t, nextIDs(t, w), "1")
+	// the changes after loading are watched from the next revision
+	putInstance(t, client, "foo", "2")
+	putInstance(t, client, "foo", "3")
+	checkIDs(t, nextIDs(t, w), "1", "2")
+	checkIDs(t, nextIDs(t, w), "1", "2", "3")
+
+	if _, err := client.Delete(context.Background(), "/microservices/foo/1"); err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, nextIDs(t, w), "2", "3")
+
+	// instances of other services with the same key prefix are ignored
+	putInstance(t, client, "foobar", "4")
+	checkIDs(t, nextIDs(t, w), "2", "3")
+
+	if n := s.rangeCount(); n != 1 {
+		t.Fatalf("got %d range requests, want 1", n)
+	}
+}
+
+func Test_watcherCompacted(t *testing.T) {
+	s, client, w := startWatch(t)
+	putInstance(t, client, "foo", "1")
+	checkIDs(t, nextIDs(t, w), "1")
+
+	// the watch falls behind the compacted revision
+	putInstance(t, client, "foo", "2")
+	s.compactTo(s.header().Revision)
+	w.watchCancel()
+	var watchCtx context.Context
+	watchCtx, w.watchCancel = context.WithCancel(w.ctx)
+	w.watchChan = w.watcher.Watch(watchCtx, w.key, clientv3.WithPrefix(), clientv3.WithRev(1))
+
+	checkIDs(t, nextIDs(t, w), "1", "2")
+	if n := s.rangeCount(); n != 2 {
+		t.Fatalf("got %d range requests, want 2", n)
+	}
+	putInstance(t, client, "foo", "3")
+	checkIDs(t, nextIDs(t, w), "1", "2", "3")
+}
+
+func Test_watcherCanceled(t *testing.T) {
+	s, client, w := startWatch(t)
+	putInstance(t, client, "foo", "1")
+	checkIDs(t, nextIDs(t, w), "1")
+
+	s.cancelWatches("server is stopping")
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Next()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errWatchClosed) {
+			t.Fatalf("got error %v, want %v", err, errWatchClosed)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("Next blocks after the watch is cancelled")
+	}
+
+	// the instances are loaded again after the error
+	putInstance(t, client, "foo", "2")
+	checkIDs(t, nextIDs(t, w), "1", "2")
+	putInstance(t, client, "foo", "3")
+	checkIDs(t, nextIDs(t, w), "1", "2", "3")
+}
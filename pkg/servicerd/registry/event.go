@@ -0,0 +1,227 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// WatchEventType is the type of a watch event.
+type WatchEventType int
+
+const (
+	// WatchEventSnapshot carries all instances of the service, it is the first event of a watcher.
+	WatchEventSnapshot WatchEventType = iota + 1
+	// WatchEventError carries the error of the watcher, the watcher keeps watching unless the channel is closed.
+	WatchEventError
+	// WatchEventResync carries all instances of the service after the watcher recovers from an error,
+	// the instances replace the ones received before the error.
+	WatchEventResync
+)
+
+// String returns the name of the event type.
+func (t WatchEventType) String() string {
+	switch t {
+	case WatchEventSnapshot:
+		return "snapshot"
+	case WatchEventError:
+		return "error"
+	case WatchEventResync:
+		return "resync"
+	}
+	return "unknown"
+}
+
+// Event is an event of an EventWatcher.
+type Event struct {
+	Type WatchEventType
+	// Instances are all instances of the service for snapshot and resync, may be empty.
+	Instances []*ServiceInstance
+	// Err is the error for error event.
+	Err error
+}
+
+// EventWatcher is a service watcher delivering events on a channel, so that consumers can select on
+// multiple watchers.
+type EventWatcher interface {
+	// Events returns the channel of events, the first event is a snapshot of the current instances even if
+	// there are none, or an error if the watcher fails before. The channel is closed after Stop or when the
+	// watcher is done, e.g. the context of Watch is cancelled.
+	Events() <-chan Event
+	// Stop stops the watcher.
+	Stop() error
+}
+
+// EventDiscovery is implemented by the discoveries which create event watchers natively.
+type EventDiscovery interface {
+	// WatchEvents creates an event watcher according to the service name.
+	WatchEvents(ctx context.Context, serviceName string) (EventWatcher, error)
+}
+
+// WatchEvents creates an event watcher of the service, the watcher of d is adapted by NewEventWatcher
+// if d does not implement EventDiscovery.
+func WatchEvents(ctx context.Context, d Discovery, serviceName string, opts ...EventOption) (EventWatcher, error) {
+	if ed, ok := d.(EventDiscovery); ok {
+		return ed.WatchEvents(ctx, serviceName)
+	}
+	w, err := d.Watch(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return NewEventWatcher(w, opts...), nil
+}
+
+// EventOption set the event watcher options.
+type EventOption func(*eventOptions)
+
+type eventOptions struct {
+	initialWait time.Duration
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+func defaultEventOptions() *eventOptions {
+	return &eventOptions{
+		initialWait: time.Second,
+		backoff:     time.Second,
+		maxBackoff:  time.Second * 30,
+	}
+}
+
+func (o *eventOptions) apply(opts ...EventOption) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithInitialWait set the time to wait for the first Next of the watcher, the first Next of some watchers
+// blocks while there are no instances, so an empty snapshot is delivered after the wait, default 1s.
+func WithInitialWait(d time.Duration) EventOption {
+	return func(o *eventOptions) {
+		o.initialWait = d
+	}
+}
+
+// WithErrorBackoff set the backoff before calling Next again after an error, it doubles up to max.
+func WithErrorBackoff(backoff time.Duration, max time.Duration) EventOption {
+	return func(o *eventOptions) {
+		o.backoff = backoff
+		o.maxBackoff = max
+	}
+}
+
+// NewEventWatcher adapts the watcher to an EventWatcher, the results of Next are delivered as snapshots,
+// errors and resyncs after errors. Stop stops the adapted watcher.
+func NewEventWatcher(w Watcher, opts ...EventOption) EventWatcher {
+	o := defaultEventOptions()
+	o.apply(opts...)
+	e := &eventWatcher{
+		w:      w,
+		opts:   o,
+		events: make(chan Event),
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	go e.run()
+	return e
+}
+
+type eventWatcher struct {
+	w      Watcher
+	opts   *eventOptions
+	events chan Event
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+}
+
+func (e *eventWatcher) Events() <-chan Event {
+	return e.events
+}
+
+func (e *eventWatcher) Stop() error {
+	var err error
+	e.stopOnce.Do(func() {
+		e.cancel()
+		err = e.w.Stop()
+	})
+	return err
+}
+
+type nextResult struct {
+	instances []*ServiceInstance
+	err       error
+}
+
+func (e *eventWatcher) run() {
+	defer close(e.events)
+
+	first := make(chan nextResult, 1)
+	go func() {
+		instances, err := e.w.Next()
+		first <- nextResult{instances: instances, err: err}
+	}()
+	timer := time.NewTimer(e.opts.initialWait)
+	defer timer.Stop()
+	var r nextResult
+	select {
+	case r = <-first:
+	case <-timer.C:
+		// the first Next blocks while there are no instances
+		if !e.send(Event{Type: WatchEventSnapshot, Instances: []*ServiceInstance{}}) {
+			return
+		}
+		select {
+		case r = <-first:
+		case <-e.ctx.Done():
+			return
+		}
+	case <-e.ctx.Done():
+		return
+	}
+
+	failed := false
+	backoff := e.opts.backoff
+	for {
+		if r.err != nil {
+			if e.ctx.Err() != nil || !e.send(Event{Type: WatchEventError, Err: r.err}) {
+				return
+			}
+			if errors.Is(r.err, context.Canceled) || errors.Is(r.err, context.DeadlineExceeded) {
+				// the watcher is done
+				return
+			}
+			failed = true
+			select {
+			case <-e.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > e.opts.maxBackoff {
+				backoff = e.opts.maxBackoff
+			}
+		} else {
+			typ := WatchEventSnapshot
+			if failed {
+				typ = WatchEventResync
+				failed = false
+				backoff = e.opts.backoff
+			}
+			if !e.send(Event{Type: typ, Instances: r.instances}) {
+				return
+			}
+		}
+		r.instances, r.err = e.w.Next()
+	}
+}
+
+// send sends the event, it returns false if the watcher is stopped.
+func (e *eventWatcher) send(ev Event) bool {
+	select {
+	case e.events <- ev:
+		return true
+	case <-e.ctx.Done():
+		return false
+	}
+}
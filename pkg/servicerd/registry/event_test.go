@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// stepWatcher returns the results of steps in order, then blocks until stopped.
+type stepWatcher struct {
+	steps chan nextResult
+	done  chan struct{}
+}
+
+func (w *stepWatcher) Next() ([]*ServiceInstance, error) {
+	select {
+	case r := <-w.steps:
+		return r.instances, r.err
+	case <-w.done:
+		return nil, context.Canceled
+	}
+}
+
+func (w *stepWatcher) Stop() error {
+	close(w.done)
+	return nil
+}
+
+func nextEvent(t *testing.T, w EventWatcher) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-w.Events():
+		if !ok {
+			t.Fatal("events channel is closed")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return Event{}
+}
+
+func TestNewEventWatcher(t *testing.T) {
+	w := &stepWatcher{steps: make(chan nextResult, 4), done: make(chan struct{})}
+	foo := []*ServiceInstance{{ID: "1", Name: "foo"}}
+	w.steps <- nextResult{instances: foo}
+	w.steps <- nextResult{err: errors.New("connection refused")}
+	w.steps <- nextResult{instances: foo}
+	w.steps <- nextResult{instances: []*ServiceInstance{}}
+
+	ew := NewEventWatcher(w, WithErrorBackoff(time.Millisecond, time.Millisecond))
+	for _, want := range []struct {
+		typ WatchEventType
+		n   int
+	}{{WatchEventSnapshot, 1}, {WatchEventError, 0}, {WatchEventResync, 1}, {WatchEventSnapshot, 0}} {
+		ev := nextEvent(t, ew)
+		if ev.Type != want.typ || len(ev.Instances) != want.n {
+			t.Fatalf("got %s event with %d instances, want %s with %d", ev.Type, len(ev.Instances), want.typ, want.n)
+		}
+		if (ev.Err != nil) != (want.typ == WatchEventError) {
+			t.Fatalf("got error %v for %s event", ev.Err, ev.Type)
+		}
+	}
+
+	if err := ew.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-ew.Events():
+		if ok {
+			t.Fatal("got event after Stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events channel is not closed after Stop")
+	}
+}
+
+func TestNewEventWatcher_emptySnapshot(t *testing.T) {
+	// the first Next blocks while there are no instances
+	d := &countDiscovery{ch: make(chan []*ServiceInstance)}
+	ctx, cancel := context.WithCancel(context.Background())
+	ew, err := WatchEvents(ctx, d, "foo", WithInitialWait(time.Millisecond*10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ew.Stop() //nolint
+
+	if ev := nextEvent(t, ew); ev.Type != WatchEventSnapshot || ev.Instances == nil || len(ev.Instances) != 0 {
+		t.Fatalf("got %s event with %v, want empty snapshot", ev.Type, ev.Instances)
+	}
+	d.ch <- []*ServiceInstance{{ID: "1", Name: "foo"}}
+	if ev := nextEvent(t, ew); ev.Type != WatchEventSnapshot || len(ev.Instances) != 1 {
+		t.Fatalf("got %s event with %d instances, want snapshot with 1", ev.Type, len(ev.Instances))
+	}
+
+	// the events channel is closed after the context of Watch is cancelled
+	cancel()
+	if ev := nextEvent(t, ew); ev.Type != WatchEventError || !errors.Is(ev.Err, context.Canceled) {
+		t.Fatalf("got %s event with %v, want context canceled", ev.Type, ev.Err)
+	}
+	select {
+	case _, ok := <-ew.Events():
+		if ok {
+			t.Fatal("got event after the context is cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events channel is not closed after the context is cancelled")
+	}
+}
+
+type nativeEventDiscovery struct {
+	countDiscovery
+	ew EventWatcher
+}
+
+func (d *nativeEventDiscovery) WatchEvents(context.Context, string) (EventWatcher, error) {
+	return d.ew, nil
+}
+
+func TestWatchEvents_native(t *testing.T) {
+	ew := NewEventWatcher(&stepWatcher{steps: make(chan nextResult), done: make(chan struct{})})
+	defer ew.Stop() //nolint
+	d := &nativeEventDiscovery{ew: ew}
+	got, err := WatchEvents(context.Background(), d, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != ew {
+		t.Fatal("native event watcher is not used")
+	}
+}
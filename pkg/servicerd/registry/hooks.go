@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// lifecycle events of a registration
+const (
+	EventRegistered   = "registered"
+	EventLeaseLost    = "lease_lost"
+	EventReRegistered = "reregistered"
+	EventGiveUp       = "give_up"
+)
+
+// Hooks are called on the lifecycle events of a registration, nil hooks are skipped, and the hooks must not block.
+type Hooks struct {
+	// OnRegistered is called after the instance is registered by Register.
+	OnRegistered func(service *ServiceInstance)
+	// OnLeaseLost is called when the registration is lost, e.g. the lease expired or the instance was removed.
+	OnLeaseLost func(service *ServiceInstance, err error)
+	// OnReRegistered is called after the registry registers the instance again.
+	OnReRegistered func(service *ServiceInstance)
+	// OnGiveUp is called when the registry stops registering the instance again, it stays unregistered.
+	OnGiveUp func(service *ServiceInstance, err error)
+}
+
+// Registered calls OnRegistered, h can be nil.
+func (h *Hooks) Registered(service *ServiceInstance) {
+	if h != nil && h.OnRegistered != nil {
+		h.OnRegistered(service)
+	}
+}
+
+// LeaseLost calls OnLeaseLost, h can be nil.
+func (h *Hooks) LeaseLost(service *ServiceInstance, err error) {
+	if h != nil && h.OnLeaseLost != nil {
+		h.OnLeaseLost(service, err)
+	}
+}
+
+// ReRegistered calls OnReRegistered, h can be nil.
+func (h *Hooks) ReRegistered(service *ServiceInstance) {
+	if h != nil && h.OnReRegistered != nil {
+		h.OnReRegistered(service)
+	}
+}
+
+// GiveUp calls OnGiveUp, h can be nil.
+func (h *Hooks) GiveUp(service *ServiceInstance, err error) {
+	if h != nil && h.OnGiveUp != nil {
+		h.OnGiveUp(service, err)
+	}
+}
+
+// ErrInstanceNotFound means the registered instance is not found in the registry.
+var ErrInstanceNotFound = errors.New("registered instance is not found")
+
+// Keeper keeps an instance registered in a registry which can lose the registration silently, e.g. the instance
+// is removed by the health check of the registry or the registry restarts without persistence.
+type Keeper struct {
+	Service  *ServiceInstance
+	Hooks    *Hooks
+	Interval time.Duration
+	// MaxRetry is the number of consecutive failed registrations before giving up.
+	MaxRetry int
+	// Exists reports whether the instance is registered, the check is skipped on error.
+	Exists func(ctx context.Context) (bool, error)
+	// Register registers the instance again.
+	Register func(ctx context.Context) error
+}
+
+// Run checks the registration every interval until ctx is done, the lost instance is registered again,
+// Run returns after giving up.
+func (k *Keeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+	lost := false
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !lost {
+			checkCtx, cancel := context.WithTimeout(ctx, k.Interval)
+			ok, err := k.Exists(checkCtx)
+			cancel()
+			if err != nil || ok {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			lost = true
+			k.Hooks.LeaseLost(k.Service, ErrInstanceNotFound)
+		}
+
+		regCtx, cancel := context.WithTimeout(ctx, k.Interval)
+		err := k.Register(regCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			lost = false
+			failures = 0
+			k.Hooks.ReRegistered(k.Service)
+			continue
+		}
+		failures++
+		if failures >= k.MaxRetry {
+			k.Hooks.GiveUp(k.Service, fmt.Errorf("register %s again failed %d times: %v", k.Service.ID, failures, err))
+			return
+		}
+	}
+}
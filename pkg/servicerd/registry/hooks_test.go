@@ -0,0 +1,73 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHooks_Nil(t *testing.T) {
+	var h *Hooks
+	si := NewServiceInstance("1", "foo", []string{"grpc://127.0.0.1:8282"})
+	h.Registered(si)
+	h.LeaseLost(si, nil)
+	h.ReRegistered(si)
+	h.GiveUp(si, nil)
+
+	h = &Hooks{}
+	h.Registered(si)
+	h.GiveUp(si, nil)
+}
+
+func TestKeeper_Run(t *testing.T) {
+	var registrations atomic.Int32
+	events := make(chan string, 10)
+	k := &Keeper{
+		Service: NewServiceInstance("1", "foo", []string{"grpc://127.0.0.1:8282"}),
+		Hooks: &Hooks{
+			OnLeaseLost:    func(*ServiceInstance, error) { events <- EventLeaseLost },
+			OnReRegistered: func(*ServiceInstance) { events <- EventReRegistered },
+			OnGiveUp:       func(*ServiceInstance, error) { events <- EventGiveUp },
+		},
+		Interval: time.Millisecond * 10,
+		MaxRetry: 2,
+		Exists: func(context.Context) (bool, error) {
+			return false, nil
+		},
+		Register: func(context.Context) error {
+			// the first registration succeeds, others fail
+			if registrations.Add(1) == 1 {
+				return nil
+			}
+			return errors.New("register failed")
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		k.Run(ctx)
+		close(done)
+	}()
+
+	for _, want := range []string{EventLeaseLost, EventReRegistered, EventLeaseLost, EventGiveUp} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got event %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for event %s", want)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("keeper is not stopped after giving up")
+	}
+	if n := registrations.Load(); n != 3 {
+		t.Fatalf("registered %d times, want 3", n)
+	}
+}
@@ -0,0 +1,211 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthFunc reports whether the service is serving.
+type HealthFunc func(ctx context.Context) bool
+
+// FromHealthServer returns a HealthFunc which checks the status of the service in the grpc health server,
+// empty service means the whole server.
+func FromHealthServer(s grpc_health_v1.HealthServer, service string) HealthFunc {
+	return func(ctx context.Context) bool {
+		resp, err := s.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			return false
+		}
+		return resp.Status == grpc_health_v1.HealthCheckResponse_SERVING
+	}
+}
+
+// ManagerOption set the registration manager options.
+type ManagerOption func(*managerOptions)
+
+type managerOptions struct {
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+}
+
+func defaultManagerOptions() *managerOptions {
+	return &managerOptions{
+		interval:  time.Second * 5,
+		timeout:   time.Second * 3,
+		threshold: 1,
+	}
+}
+
+func (o *managerOptions) apply(opts ...ManagerOption) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithHealthInterval set the interval of health checks.
+func WithHealthInterval(interval time.Duration) ManagerOption {
+	return func(o *managerOptions) {
+		o.interval = interval
+	}
+}
+
+// WithHealthTimeout set the timeout of a health check and a registration.
+func WithHealthTimeout(timeout time.Duration) ManagerOption {
+	return func(o *managerOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithUnhealthyThreshold set the number of consecutive failed health checks before deregistering.
+func WithUnhealthyThreshold(n int) ManagerOption {
+	return func(o *managerOptions) {
+		if n > 0 {
+			o.threshold = n
+		}
+	}
+}
+
+// Manager keeps the registration of an instance in line with the health of the service, the instance
+// is deregistered when the service is not serving and registered again when it recovers.
+type Manager struct {
+	r        Registry
+	instance *ServiceInstance
+	health   HealthFunc
+	opts     *managerOptions
+
+	mu         sync.Mutex
+	registered bool
+	stopped    bool
+	failures   int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewManager creates a registration manager of the instance.
+func NewManager(r Registry, instance *ServiceInstance, health HealthFunc, opts ...ManagerOption) *Manager {
+	o := defaultManagerOptions()
+	o.apply(opts...)
+	return &Manager{
+		r:        r,
+		instance: instance,
+		health:   health,
+		opts:     o,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start registers the instance if the service is serving, and checks the health of the service every interval
+// until Stop is called. If the first registration fails, the error is returned and the health checks are not
+// started.
+func (m *Manager) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := m.check(ctx); err != nil {
+		cancel()
+		return err
+	}
+	m.cancel = cancel
+	go m.run(ctx)
+	return nil
+}
+
+// Stop stops the health checks and deregisters the instance if it is registered.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	m.stopped = true
+	m.mu.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+		<-m.done
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.registered {
+		return nil
+	}
+	m.registered = false
+	return m.r.Deregister(ctx, m.instance)
+}
+
+// Reregister registers the instance again if the service is serving, e.g. after the registry gives up keeping
+// the registration. If the service is not serving, the instance is registered after it recovers.
+func (m *Manager) Reregister(ctx context.Context) error {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return nil
+	}
+	m.registered = false
+	m.mu.Unlock()
+	return m.check(ctx)
+}
+
+// Registered reports whether the instance is registered.
+func (m *Manager) Registered() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.registered
+}
+
+func (m *Manager) run(ctx context.Context) {
+	defer close(m.done)
+	ticker := time.NewTicker(m.opts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.check(ctx); err != nil {
+				fmt.Printf("[registry] %v\n", err)
+			}
+		}
+	}
+}
+
+// check registers or deregisters the instance by the health of the service.
+func (m *Manager) check(ctx context.Context) error {
+	checkCtx, cancel := context.WithTimeout(ctx, m.opts.timeout)
+	healthy := m.health(checkCtx)
+	cancel()
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return nil
+	}
+	if healthy {
+		m.failures = 0
+		if m.registered {
+			return nil
+		}
+		regCtx, cancel := context.WithTimeout(ctx, m.opts.timeout)
+		defer cancel()
+		if err := m.r.Register(regCtx, m.instance); err != nil {
+			return fmt.Errorf("register %s failed: %v", m.instance.ID, err)
+		}
+		m.registered = true
+		return nil
+	}
+
+	m.failures++
+	if !m.registered || m.failures < m.opts.threshold {
+		return nil
+	}
+	regCtx, cancel := context.WithTimeout(ctx, m.opts.timeout)
+	defer cancel()
+	if err := m.r.Deregister(regCtx, m.instance); err != nil {
+		return fmt.Errorf("deregister unhealthy %s failed: %v", m.instance.ID, err)
+	}
+	m.registered = false
+	return nil
+}
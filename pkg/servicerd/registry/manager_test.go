@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type memRegistry struct {
+	mu        sync.Mutex
+	instances map[string]*ServiceInstance
+}
+
+func (r *memRegistry) Register(_ context.Context, service *ServiceInstance) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.instances[service.ID] = service
+	return nil
+}
+
+func (r *memRegistry) Deregister(_ context.Context, service *ServiceInstance) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.instances, service.ID)
+	return nil
+}
+
+// failRegistry fails all registrations and counts them.
+type failRegistry struct {
+	mu            sync.Mutex
+	registrations int
+}
+
+func (r *failRegistry) Register(context.Context, *ServiceInstance) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registrations++
+	return errors.New("register failed")
+}
+
+func (r *failRegistry) Deregister(context.Context, *ServiceInstance) error {
+	return nil
+}
+
+func (r *failRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.registrations
+}
+
+func (r *memRegistry) has(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.instances[id]
+	return ok
+}
+
+func TestManager(t *testing.T) {
+	hs := health.NewServer()
+	hs.SetServingStatus("dtm", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	r := &memRegistry{instances: make(map[string]*ServiceInstance)}
+	instance := NewServiceInstance("1", "dtmservice", []string{"grpc://127.0.0.1:36790"})
+
+	m := NewManager(r, instance, FromHealthServer(hs, "dtm"),
+		WithHealthInterval(time.Millisecond*20),
+		WithUnhealthyThreshold(2),
+	)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Registered() || r.has("1") {
+		t.Fatal("registered when not serving")
+	}
+
+	hs.SetServingStatus("dtm", grpc_health_v1.HealthCheckResponse_SERVING)
+	waitFor(t, func() bool { return r.has("1") })
+
+	hs.SetServingStatus("dtm", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	waitFor(t, func() bool { return !r.has("1") })
+
+	hs.SetServingStatus("dtm", grpc_health_v1.HealthCheckResponse_SERVING)
+	waitFor(t, func() bool { return r.has("1") })
+
+	if err := m.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m.Registered() || r.has("1") {
+		t.Fatal("registered after stop")
+	}
+}
+
+func TestManager_StartFailed(t *testing.T) {
+	r := &failRegistry{}
+	instance := NewServiceInstance("1", "dtmservice", []string{"grpc://127.0.0.1:36790"})
+	m := NewManager(r, instance, func(context.Context) bool { return true }, WithHealthInterval(time.Millisecond*10))
+	if err := m.Start(); err == nil {
+		t.Fatal("expect error of the first registration")
+	}
+
+	// the health checks are not started after the failed start
+	time.Sleep(time.Millisecond * 50)
+	if n := r.count(); n != 1 {
+		t.Fatalf("registered %d times, want 1", n)
+	}
+	if err := m.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,355 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
+
+	"go.uber.org/zap"
+)
+
+// operations of Registry and Discovery passed to middlewares
+const (
+	OperationRegister   = "register"
+	OperationDeregister = "deregister"
+	OperationUpdate     = "update"
+	OperationDrain      = "drain"
+	OperationGetService = "get_service"
+	OperationWatch      = "watch"
+	OperationGetConfig  = "get_config"
+)
+
+// Middleware decorates a Registry and a Discovery with a cross-cutting behavior,
+// either function can be nil if the middleware only applies to one of them.
+type Middleware struct {
+	Registry  func(next Registry) Registry
+	Discovery func(next Discovery) Discovery
+}
+
+// Chain wraps the discovery with the middlewares, the first middleware is the outermost,
+// e.g. registry.Chain(d, registry.WithRetry(3, time.Second), registry.WithFilter(registry.FilterVersion("v1"))).
+// The wrapped discovery implements ConfigGetter and io.Closer by forwarding to d.
+func Chain(d Discovery, mws ...Middleware) Discovery {
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i].Discovery != nil {
+			d = mws[i].Discovery(d)
+		}
+	}
+	return d
+}
+
+// ChainRegistry wraps the registry with the middlewares, the first middleware is the outermost,
+// the wrapped registry implements Updater, Drainer and io.Closer by forwarding to r, use UnwrapRegistry to get the
+// registry of the backend.
+func ChainRegistry(r Registry, mws ...Middleware) Registry {
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i].Registry != nil {
+			r = mws[i].Registry(r)
+		}
+	}
+	return r
+}
+
+// UnwrapRegistry returns the innermost registry of the middleware chain.
+func UnwrapRegistry(r Registry) Registry {
+	for {
+		u, ok := r.(interface{ Unwrap() Registry })
+		if !ok {
+			return r
+		}
+		r = u.Unwrap()
+	}
+}
+
+// registryBase forwards the optional interfaces of the wrapped registry.
+type registryBase struct {
+	next Registry
+}
+
+// Unwrap returns the wrapped registry.
+func (r *registryBase) Unwrap() Registry {
+	return r.next
+}
+
+// Update updates the instance if the wrapped registry implements Updater.
+func (r *registryBase) Update(ctx context.Context, service *ServiceInstance) error {
+	if u, ok := r.next.(Updater); ok {
+		return u.Update(ctx, service)
+	}
+	return ErrUpdateNotSupported
+}
+
+// Drain drains the instance if the wrapped registry implements Drainer.
+func (r *registryBase) Drain(ctx context.Context, service *ServiceInstance) error {
+	if d, ok := r.next.(Drainer); ok {
+		return d.Drain(ctx, service)
+	}
+	return ErrDrainNotSupported
+}
+
+// Close closes the wrapped registry if it implements io.Closer.
+func (r *registryBase) Close() error {
+	if c, ok := r.next.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// discoveryBase forwards the optional interfaces of the wrapped discovery.
+type discoveryBase struct {
+	next Discovery
+}
+
+// GetConfig returns the configuration of the service by key if the wrapped discovery implements ConfigGetter.
+func (d *discoveryBase) GetConfig(ctx context.Context, serviceName string, key string) (string, error) {
+	if cg, ok := d.next.(ConfigGetter); ok {
+		return cg.GetConfig(ctx, serviceName, key)
+	}
+	return "", nil
+}
+
+// Close closes the wrapped discovery if it implements io.Closer.
+func (d *discoveryBase) Close() error {
+	if c, ok := d.next.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------------------------
+
+// aroundFunc runs call of the operation on the service, it may check, record or retry the call.
+type aroundFunc func(ctx context.Context, operation string, serviceName string, call func(context.Context) error) error
+
+// aroundMiddleware applies around to every operation of Registry and Discovery.
+func aroundMiddleware(around aroundFunc) Middleware {
+	return Middleware{
+		Registry: func(next Registry) Registry {
+			return &aroundRegistry{registryBase: registryBase{next: next}, around: around}
+		},
+		Discovery: func(next Discovery) Discovery {
+			return &aroundDiscovery{discoveryBase: discoveryBase{next: next}, around: around}
+		},
+	}
+}
+
+type aroundRegistry struct {
+	registryBase
+	around aroundFunc
+}
+
+func (r *aroundRegistry) Register(ctx context.Context, service *ServiceInstance) error {
+	return r.around(ctx, OperationRegister, service.Name, func(ctx context.Context) error {
+		return r.next.Register(ctx, service)
+	})
+}
+
+func (r *aroundRegistry) Deregister(ctx context.Context, service *ServiceInstance) error {
+	return r.around(ctx, OperationDeregister, service.Name, func(ctx context.Context) error {
+		return r.next.Deregister(ctx, service)
+	})
+}
+
+func (r *aroundRegistry) Update(ctx context.Context, service *ServiceInstance) error {
+	return r.around(ctx, OperationUpdate, service.Name, func(ctx context.Context) error {
+		return r.registryBase.Update(ctx, service)
+	})
+}
+
+func (r *aroundRegistry) Drain(ctx context.Context, service *ServiceInstance) error {
+	return r.around(ctx, OperationDrain, service.Name, func(ctx context.Context) error {
+		return r.registryBase.Drain(ctx, service)
+	})
+}
+
+type aroundDiscovery struct {
+	discoveryBase
+	around aroundFunc
+}
+
+func (d *aroundDiscovery) GetService(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	var instances []*ServiceInstance
+	err := d.around(ctx, OperationGetService, serviceName, func(ctx context.Context) error {
+		var err error
+		instances, err = d.next.GetService(ctx, serviceName)
+		return err
+	})
+	return instances, err
+}
+
+func (d *aroundDiscovery) Watch(ctx context.Context, serviceName string) (Watcher, error) {
+	var w Watcher
+	err := d.around(ctx, OperationWatch, serviceName, func(ctx context.Context) error {
+		var err error
+		w, err = d.next.Watch(ctx, serviceName)
+		return err
+	})
+	return w, err
+}
+
+func (d *aroundDiscovery) GetConfig(ctx context.Context, serviceName string, key string) (string, error) {
+	var value string
+	err := d.around(ctx, OperationGetConfig, serviceName, func(ctx context.Context) error {
+		var err error
+		value, err = d.discoveryBase.GetConfig(ctx, serviceName, key)
+		return err
+	})
+	return value, err
+}
+
+// ------------------------------------------------------------------------------------------
+
+// WithRetry retries the failed operations up to attempts times in total, the backoff doubles after every retry.
+func WithRetry(attempts int, backoff time.Duration) Middleware {
+	return aroundMiddleware(func(ctx context.Context, _ string, _ string, call func(context.Context) error) error {
+		var err error
+		delay := backoff
+		for i := 0; i < attempts || i == 0; i++ {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(delay):
+				}
+				delay *= 2
+			}
+			if err = call(ctx); err == nil || errors.Is(err, ErrUpdateNotSupported) || errors.Is(err, ErrDrainNotSupported) {
+				return err
+			}
+		}
+		return err
+	})
+}
+
+// WithMetrics records the latency of operations as registry requests of the backend.
+func WithMetrics(m *metrics.Metrics, backend string) Middleware {
+	return aroundMiddleware(func(ctx context.Context, operation string, _ string, call func(context.Context) error) error {
+		defer m.Request(backend, operation, time.Now())
+		return call(ctx)
+	})
+}
+
+// WithLogger logs the operations, failed operations are logged at warn level, others at debug level.
+func WithLogger(l *zap.Logger) Middleware {
+	return aroundMiddleware(func(ctx context.Context, operation string, serviceName string, call func(context.Context) error) error {
+		start := time.Now()
+		err := call(ctx)
+		fields := []zap.Field{
+			zap.String("operation", operation),
+			zap.String("service", serviceName),
+			zap.Duration("duration", time.Since(start)),
+		}
+		if err != nil {
+			l.Warn("registry operation failed", append(fields, zap.Error(err))...)
+		} else {
+			l.Debug("registry operation", fields...)
+		}
+		return err
+	})
+}
+
+// Authorizer returns an error if the operation on the service is not allowed.
+type Authorizer func(ctx context.Context, operation string, serviceName string) error
+
+// WithAuthorization rejects the operations which are not allowed by the authorizer.
+func WithAuthorization(authorize Authorizer) Middleware {
+	return aroundMiddleware(func(ctx context.Context, operation string, serviceName string, call func(context.Context) error) error {
+		if err := authorize(ctx, operation, serviceName); err != nil {
+			return err
+		}
+		return call(ctx)
+	})
+}
+
+// WithCache answers GetService from a cached discovery, see NewCachedDiscovery.
+func WithCache(opts ...CacheOption) Middleware {
+	return Middleware{
+		Discovery: func(next Discovery) Discovery {
+			return NewCachedDiscovery(next, opts...)
+		},
+	}
+}
+
+// ------------------------------------------------------------------------------------------
+
+// Filter reports whether the instance is kept.
+type Filter func(*ServiceInstance) bool
+
+// FilterVersion keeps the instances of the versions.
+func FilterVersion(versions ...string) Filter {
+	return func(in *ServiceInstance) bool {
+		for _, v := range versions {
+			if in.Version == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FilterMetadata keeps the instances whose metadata of key is value.
+func FilterMetadata(key string, value string) Filter {
+	return func(in *ServiceInstance) bool {
+		return in.Metadata[key] == value
+	}
+}
+
+// WithFilter keeps the instances which pass all filters in the results of GetService and watchers.
+func WithFilter(filters ...Filter) Middleware {
+	return Middleware{
+		Discovery: func(next Discovery) Discovery {
+			return &filterDiscovery{discoveryBase: discoveryBase{next: next}, filters: filters}
+		},
+	}
+}
+
+type filterDiscovery struct {
+	discoveryBase
+	filters []Filter
+}
+
+func (d *filterDiscovery) GetService(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	instances, err := d.next.GetService(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return d.filter(instances), nil
+}
+
+func (d *filterDiscovery) Watch(ctx context.Context, serviceName string) (Watcher, error) {
+	w, err := d.next.Watch(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &filterWatcher{Watcher: w, d: d}, nil
+}
+
+func (d *filterDiscovery) filter(instances []*ServiceInstance) []*ServiceInstance {
+	result := make([]*ServiceInstance, 0, len(instances))
+next:
+	for _, in := range instances {
+		for _, f := range d.filters {
+			if !f(in) {
+				continue next
+			}
+		}
+		result = append(result, in)
+	}
+	return result
+}
+
+type filterWatcher struct {
+	Watcher
+	d *filterDiscovery
+}
+
+func (w *filterWatcher) Next() ([]*ServiceInstance, error) {
+	instances, err := w.Watcher.Next()
+	if err != nil {
+		return nil, err
+	}
+	return w.d.filter(instances), nil
+}
@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
+)
+
+type flakyRegistry struct {
+	fails     int
+	registers int
+}
+
+func (r *flakyRegistry) Register(context.Context, *ServiceInstance) error {
+	r.registers++
+	if r.registers <= r.fails {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (r *flakyRegistry) Deregister(context.Context, *ServiceInstance) error {
+	return nil
+}
+
+type configDiscovery struct {
+	countDiscovery
+}
+
+func (d *configDiscovery) GetConfig(context.Context, string, string) (string, error) {
+	return "v1:100", nil
+}
+
+func TestChainRegistry(t *testing.T) {
+	r := &flakyRegistry{fails: 2}
+	var ops []string
+	wrapped := ChainRegistry(r,
+		WithAuthorization(func(_ context.Context, operation string, _ string) error {
+			ops = append(ops, operation)
+			return nil
+		}),
+		WithRetry(3, time.Millisecond),
+		WithMetrics(metrics.New(prometheus.NewRegistry()), "test"),
+		WithLogger(zap.NewNop()),
+	)
+
+	err := wrapped.Register(context.Background(), &ServiceInstance{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.registers != 3 {
+		t.Fatalf("got %d registers, want 3", r.registers)
+	}
+	if len(ops) != 1 || ops[0] != OperationRegister {
+		t.Fatalf("got operations %v", ops)
+	}
+	if UnwrapRegistry(wrapped) != r {
+		t.Fatal("UnwrapRegistry() does not return the backend registry")
+	}
+
+	err = wrapped.(Updater).Update(context.Background(), &ServiceInstance{Name: "foo"})
+	if !errors.Is(err, ErrUpdateNotSupported) {
+		t.Fatalf("Update() = %v, want ErrUpdateNotSupported", err)
+	}
+
+	r = &flakyRegistry{fails: 5}
+	err = ChainRegistry(r, WithRetry(3, time.Millisecond)).Register(context.Background(), &ServiceInstance{Name: "foo"})
+	if err == nil || r.registers != 3 {
+		t.Fatalf("got %v after %d registers", err, r.registers)
+	}
+}
+
+func TestChain(t *testing.T) {
+	d := &configDiscovery{countDiscovery{
+		instances: []*ServiceInstance{
+			{ID: "1", Version: "v1"},
+			{ID: "2", Version: "v2", Metadata: map[string]string{"zone": "a"}},
+			{ID: "3", Version: "v2", Metadata: map[string]string{"zone": "b"}},
+		},
+		ch: make(chan []*ServiceInstance, 1),
+	}}
+	wrapped := Chain(d,
+		WithAuthorization(func(_ context.Context, operation string, _ string) error {
+			if operation == OperationWatch {
+				return errors.New("forbidden")
+			}
+			return nil
+		}),
+		WithFilter(FilterVersion("v2"), FilterMetadata("zone", "a")),
+	)
+
+	ins, err := wrapped.GetService(context.Background(), "foo")
+	if err != nil || len(ins) != 1 || ins[0].ID != "2" {
+		t.Fatalf("GetService() = %v, %v", ins, err)
+	}
+	if _, err = wrapped.Watch(context.Background(), "foo"); err == nil {
+		t.Fatal("expected forbidden error")
+	}
+	value, err := wrapped.(ConfigGetter).GetConfig(context.Background(), "foo", ConfigKeyTrafficSplit)
+	if err != nil || value != "v1:100" {
+		t.Fatalf("GetConfig() = %q, %v", value, err)
+	}
+
+	w, err := Chain(d, WithFilter(FilterVersion("v1"))).Watch(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.ch <- d.instances
+	ins, err = w.Next()
+	if err != nil || len(ins) != 1 || ins[0].ID != "1" {
+		t.Fatalf("Next() = %v, %v", ins, err)
+	}
+}
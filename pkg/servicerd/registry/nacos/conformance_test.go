@@ -0,0 +1,218 @@
+package nacos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/registrytest"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+)
+
+// fakeNacos is a nacos server which keeps the instances in memory,
+// the subscribers of its clients are notified of the changes of services.
+type fakeNacos struct {
+	mu        sync.Mutex
+	services  map[string]map[string]model.Instance // group@@service -> ip:port -> instance
+	callbacks map[string][]*vo.SubscribeParam      // group@@service -> subscriptions
+	failures  int                                  // number of registrations to fail
+}
+
+func newFakeNacos() *fakeNacos {
+	return &fakeNacos{
+		services:  make(map[string]map[string]model.Instance),
+		callbacks: make(map[string][]*vo.SubscribeParam),
+	}
+}
+
+func groupedName(group string, service string) string {
+	return group + "@@" + service
+}
+
+// hosts returns a copy of the instances of the service, the caller must hold the lock.
+func (s *fakeNacos) hosts(key string) []model.Instance {
+	hosts := make([]model.Instance, 0, len(s.services[key]))
+	for _, in := range s.services[key] {
+		md := make(map[string]string, len(in.Metadata))
+		for k, v := range in.Metadata {
+			md[k] = v
+		}
+		in.Metadata = md
+		hosts = append(hosts, in)
+	}
+	return hosts
+}
+
+// change changes the instances of the service and notifies the subscribers.
+func (s *fakeNacos) change(key string, fn func(instances map[string]model.Instance)) {
+	s.mu.Lock()
+	if s.services[key] == nil {
+		s.services[key] = make(map[string]model.Instance)
+	}
+	fn(s.services[key])
+	subscriptions := append([]*vo.SubscribeParam{}, s.callbacks[key]...)
+	s.mu.Unlock()
+
+	for _, sub := range subscriptions {
+		s.mu.Lock()
+		hosts := s.hosts(key)
+		s.mu.Unlock()
+		sub.SubscribeCallback(hosts, nil)
+	}
+}
+
+// fakeNacosClient is a naming client of fakeNacos.
+type fakeNacosClient struct {
+	naming_client.INamingClient
+	server *fakeNacos
+}
+
+func (c *fakeNacosClient) RegisterInstance(param vo.RegisterInstanceParam) (bool, error) {
+	c.server.mu.Lock()
+	fail := c.server.failures > 0
+	if fail {
+		c.server.failures--
+	}
+	c.server.mu.Unlock()
+	if fail {
+		return false, errors.New("register failed")
+	}
+
+	key := groupedName(param.GroupName, param.ServiceName)
+	c.server.change(key, func(instances map[string]model.Instance) {
+		addr := fmt.Sprintf("%s:%d", param.Ip, param.Port)
+		instances[addr] = model.Instance{
+			InstanceId:  fmt.Sprintf("%s#%d#%s#%s", param.Ip, param.Port, param.ClusterName, key),
+			Ip:          param.Ip,
+			Port:        param.Port,
+			Weight:      param.Weight,
+			Enable:      param.Enable,
+			Healthy:     param.Healthy,
+			Ephemeral:   param.Ephemeral,
+			Metadata:    param.Metadata,
+			ClusterName: param.ClusterName,
+			ServiceName: key,
+		}
+	})
+	return true, nil
+}
+
+func (c *fakeNacosClient) UpdateInstance(param vo.UpdateInstanceParam) (bool, error) {
+	return c.RegisterInstance(vo.RegisterInstanceParam{
+		Ip:          param.Ip,
+		Port:        param.Port,
+		Weight:      param.Weight,
+		Enable:      param.Enable,
+		Healthy:     param.Healthy,
+		Metadata:    param.Metadata,
+		ClusterName: param.ClusterName,
+		ServiceName: param.ServiceName,
+		GroupName:   param.GroupName,
+		Ephemeral:   param.Ephemeral,
+	})
+}
+
+func (c *fakeNacosClient) DeregisterInstance(param vo.DeregisterInstanceParam) (bool, error) {
+	c.server.change(groupedName(param.GroupName, param.ServiceName), func(instances map[string]model.Instance) {
+		delete(instances, fmt.Sprintf("%s:%d", param.Ip, param.Port))
+	})
+	return true, nil
+}
+
+func (c *fakeNacosClient) GetService(param vo.GetServiceParam) (model.Service, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return model.Service{
+		Name:  param.ServiceName,
+		Hosts: c.server.hosts(groupedName(param.GroupName, param.ServiceName)),
+	}, nil
+}
+
+func (c *fakeNacosClient) SelectInstances(param vo.SelectInstancesParam) ([]model.Instance, error) {
+	c.server.mu.Lock()
+	hosts := c.server.hosts(groupedName(param.GroupName, param.ServiceName))
+	c.server.mu.Unlock()
+
+	instances := make([]model.Instance, 0, len(hosts))
+	for _, in := range hosts {
+		if param.HealthyOnly && (!in.Healthy || !in.Enable || in.Weight <= 0) {
+			continue
+		}
+		instances = append(instances, in)
+	}
+	if len(instances) == 0 {
+		// same as the nacos client
+		return instances, errors.New("instance list is empty!") //nolint
+	}
+	return instances, nil
+}
+
+func (c *fakeNacosClient) Subscribe(param *vo.SubscribeParam) error {
+	key := groupedName(param.GroupName, param.ServiceName)
+	c.server.mu.Lock()
+	c.server.callbacks[key] = append(c.server.callbacks[key], param)
+	hosts := c.server.hosts(key)
+	c.server.mu.Unlock()
+
+	if len(hosts) > 0 {
+		param.SubscribeCallback(hosts, nil)
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription of the same param like the nacos client.
+func (c *fakeNacosClient) Unsubscribe(param *vo.SubscribeParam) error {
+	key := groupedName(param.GroupName, param.ServiceName)
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	subscriptions := c.server.callbacks[key][:0]
+	for _, sub := range c.server.callbacks[key] {
+		if sub != param {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	c.server.callbacks[key] = subscriptions
+	return nil
+}
+
+func (c *fakeNacosClient) CloseClient() {}
+
+func TestConformance(t *testing.T) {
+	registrytest.RunConformance(t, func(t *testing.T) *registrytest.Backend {
+		server := newFakeNacos()
+		newRegistry := func() *Registry {
+			r := New(&fakeNacosClient{server: server})
+			t.Cleanup(func() { _ = r.Close() })
+			return r
+		}
+		return &registrytest.Backend{
+			NewRegistry: func() registry.Registry { return newRegistry() },
+			Discovery:   newRegistry(),
+			// the instances are registered as name.kind
+			ServiceName: func(name string) string { return name + ".grpc" },
+		}
+	})
+}
+
+func TestWatcher_StopUnsubscribes(t *testing.T) {
+	server := newFakeNacos()
+	r := New(&fakeNacosClient{server: server})
+	defer r.Close() //nolint
+
+	w, err := r.Watch(context.Background(), "foo.grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.callbacks[groupedName(r.opts.group, "foo.grpc")]); n != 0 {
+		t.Fatalf("%d subscriptions left after stop", n)
+	}
+}
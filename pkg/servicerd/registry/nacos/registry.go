@@ -4,21 +4,33 @@ package nacos
 import (
 	"context"
 	"fmt"
-	"net"
-	"net/url"
+	"io"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/nacoscli"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 
 	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
 	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
 	"github.com/nacos-group/nacos-sdk-go/v2/vo"
 )
 
+const backend = "nacos"
+
+// metadata key of the registered endpoint, which keeps isSecure and attributes of the endpoint
+const metadataKeyEndpoint = "endpoint"
+
 var (
-	_ registry.Registry  = (*Registry)(nil)
-	_ registry.Discovery = (*Registry)(nil)
+	_ registry.Registry     = (*Registry)(nil)
+	_ registry.Discovery    = (*Registry)(nil)
+	_ registry.ConfigGetter = (*Registry)(nil)
+	_ registry.Updater      = (*Registry)(nil)
+	_ registry.Drainer      = (*Registry)(nil)
+	_ io.Closer             = (*Registry)(nil)
 )
 
 type options struct {
@@ -27,6 +39,10 @@ type options struct {
 	cluster string
 	group   string
 	kind    string
+	metrics *metrics.Metrics
+	hooks   *registry.Hooks
+
+	checkInterval time.Duration // interval of checking the registrations
 }
 
 // Option is nacos option.
@@ -57,10 +73,29 @@ func WithDefaultKind(kind string) Option {
 	return func(o *options) { o.kind = kind }
 }
 
+// WithMetrics set prometheus metrics.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *options) { o.metrics = m }
+}
+
+// WithHooks set the hooks of registration lifecycle events, the registration is lost when the instance is
+// not found in nacos.
+func WithHooks(hooks *registry.Hooks) Option {
+	return func(o *options) { o.hooks = hooks }
+}
+
 // Registry is nacos registry.
 type Registry struct {
 	opts options
 	cli  naming_client.INamingClient
+
+	mu       sync.Mutex
+	keepers  map[string]context.CancelFunc        // stops checking the registration of instance id
+	services map[string]*registry.ServiceInstance // latest instance of id, replaced by Update and Drain
+
+	// cancelled by Close, stops the watchers
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewRegistry instantiating the nacos registry
@@ -85,133 +120,343 @@ func New(cli naming_client.INamingClient, opts ...Option) (r *Registry) {
 		group:   constant.DEFAULT_GROUP,
 		weight:  100,
 		kind:    "grpc",
+
+		checkInterval: time.Second * 20,
 	}
 	for _, option := range opts {
 		option(&op)
 	}
-	return &Registry{
-		opts: op,
-		cli:  cli,
+	r = &Registry{
+		opts:     op,
+		cli:      cli,
+		keepers:  make(map[string]context.CancelFunc),
+		services: make(map[string]*registry.ServiceInstance),
 	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
 }
 
 // Register the registration.
 func (r *Registry) Register(_ context.Context, si *registry.ServiceInstance) error {
-	if si.Name == "" {
-		return fmt.Errorf("nacos: serviceInstance.name can not be empty")
+	if err := si.Validate(); err != nil {
+		return fmt.Errorf("nacos: %v", err)
 	}
+	if err := r.register(si); err != nil {
+		return err
+	}
+	r.opts.hooks.Registered(si)
+
+	// nacos removes the instance when its client loses the connection for a while
+	keeper := &registry.Keeper{
+		Service:  si,
+		Hooks:    r.opts.hooks,
+		Interval: r.opts.checkInterval,
+		MaxRetry: 5,
+		Exists: func(context.Context) (bool, error) {
+			return r.exists(r.latest(si))
+		},
+		Register: func(context.Context) error {
+			// the updated or drained instance is registered as it is
+			return r.register(r.latest(si))
+		},
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.mu.Lock()
+	if stop, ok := r.keepers[si.ID]; ok {
+		stop()
+	}
+	r.keepers[si.ID] = cancel
+	r.services[si.ID] = si
+	r.mu.Unlock()
+	go keeper.Run(ctx)
+	return nil
+}
+
+// register registers the instances of all endpoints, the instances of a draining service are disabled.
+func (r *Registry) register(si *registry.ServiceInstance) error {
+	enable := si.Metadata[registry.MetadataKeyStatus] != registry.StatusDraining
 	for _, endpoint := range si.Endpoints {
-		u, err := url.Parse(endpoint)
+		in, err := r.newInstance(si, endpoint)
 		if err != nil {
 			return err
 		}
-		host, port, err := net.SplitHostPort(u.Host)
+		start := time.Now()
+		_, e := r.cli.RegisterInstance(vo.RegisterInstanceParam{
+			Ip:          in.host,
+			Port:        in.port,
+			ServiceName: in.serviceName,
+			Weight:      in.weight,
+			Enable:      enable,
+			Healthy:     true,
+			Ephemeral:   true,
+			Metadata:    in.metadata,
+			ClusterName: r.opts.cluster,
+			GroupName:   r.opts.group,
+		})
+		r.opts.metrics.Request(backend, "register", start)
+		r.opts.metrics.Register(backend, e)
+		if e != nil {
+			return fmt.Errorf("RegisterInstance err %v, id = %s", e, si.ID)
+		}
+	}
+	return nil
+}
+
+// exists reports whether the instances of all endpoints are registered.
+func (r *Registry) exists(si *registry.ServiceInstance) (bool, error) {
+	for _, endpoint := range si.Endpoints {
+		in, err := r.newInstance(si, endpoint)
 		if err != nil {
-			return err
+			return false, err
 		}
-		p, err := strconv.Atoi(port)
+		res, err := r.cli.GetService(vo.GetServiceParam{
+			ServiceName: in.serviceName,
+			GroupName:   r.opts.group,
+		})
 		if err != nil {
-			return err
+			return false, err
 		}
-		var rmd map[string]string
-		if si.Metadata == nil {
-			rmd = map[string]string{
-				"id":      si.ID,
-				"kind":    u.Scheme,
-				"version": si.Version,
-			}
-		} else {
-			rmd = make(map[string]string, len(si.Metadata)+2)
-			for k, v := range si.Metadata {
-				rmd[k] = v
+		found := false
+		for _, host := range res.Hosts {
+			if host.Ip == in.host && host.Port == in.port {
+				found = true
+				break
 			}
-			rmd["id"] = si.ID
-			rmd["kind"] = u.Scheme
-			rmd["version"] = si.Version
 		}
-		_, e := r.cli.RegisterInstance(vo.RegisterInstanceParam{
-			Ip:          host,
-			Port:        uint64(p),
-			ServiceName: si.Name + "." + u.Scheme,
-			Weight:      r.opts.weight,
-			Enable:      true,
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Update updates the metadata, version and weight of the registered instance.
+func (r *Registry) Update(_ context.Context, si *registry.ServiceInstance) error {
+	if err := r.update(si, true); err != nil {
+		return err
+	}
+	r.setLatest(si)
+	return nil
+}
+
+// Drain disables the registered instance, and marks it with metadata status=draining.
+func (r *Registry) Drain(_ context.Context, si *registry.ServiceInstance) error {
+	si = registry.Draining(si)
+	if err := r.update(si, false); err != nil {
+		return err
+	}
+	r.setLatest(si)
+	return nil
+}
+
+// latest returns the latest instance of the registered si, which is registered again by the keeper.
+func (r *Registry) latest(si *registry.ServiceInstance) *registry.ServiceInstance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if in, ok := r.services[si.ID]; ok {
+		return in
+	}
+	return si
+}
+
+func (r *Registry) setLatest(si *registry.ServiceInstance) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keepers[si.ID]; ok {
+		r.services[si.ID] = si
+	}
+}
+
+func (r *Registry) update(si *registry.ServiceInstance, enable bool) error {
+	if err := si.Validate(); err != nil {
+		return fmt.Errorf("nacos: %v", err)
+	}
+	for _, endpoint := range si.Endpoints {
+		in, err := r.newInstance(si, endpoint)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		_, e := r.cli.UpdateInstance(vo.UpdateInstanceParam{
+			Ip:          in.host,
+			Port:        in.port,
+			ServiceName: in.serviceName,
+			Weight:      in.weight,
+			Enable:      enable,
 			Healthy:     true,
 			Ephemeral:   true,
-			Metadata:    rmd,
+			Metadata:    in.metadata,
 			ClusterName: r.opts.cluster,
 			GroupName:   r.opts.group,
 		})
+		r.opts.metrics.Request(backend, "update", start)
 		if e != nil {
-			return fmt.Errorf("RegisterInstance err %v, id = %s", e, si.ID)
+			return fmt.Errorf("UpdateInstance err %v, id = %s", e, si.ID)
 		}
 	}
 	return nil
 }
 
+// instance is a nacos instance of an endpoint of the service instance.
+type instance struct {
+	host        string
+	port        uint64
+	serviceName string
+	weight      float64
+	metadata    map[string]string
+}
+
+func (r *Registry) newInstance(si *registry.ServiceInstance, endpoint string) (*instance, error) {
+	e, err := registry.ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	rmd := make(map[string]string, len(si.Metadata)+4)
+	for k, v := range si.Metadata {
+		rmd[k] = v
+	}
+	rmd["id"] = si.ID
+	rmd["kind"] = e.Scheme
+	rmd["version"] = si.Version
+	rmd[metadataKeyEndpoint] = endpoint
+
+	weight := r.opts.weight
+	if v, ok := si.Metadata[registry.MetadataKeyWeight]; ok {
+		w, err := strconv.ParseFloat(v, 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("nacos: invalid weight %q of %s", v, si.ID)
+		}
+		weight = w
+	}
+
+	return &instance{
+		host:        e.Host,
+		port:        uint64(e.Port),
+		serviceName: si.Name + "." + e.Scheme,
+		weight:      weight,
+		metadata:    rmd,
+	}, nil
+}
+
 // Deregister the registration.
 func (r *Registry) Deregister(_ context.Context, service *registry.ServiceInstance) error {
+	r.mu.Lock()
+	if stop, ok := r.keepers[service.ID]; ok {
+		stop()
+		delete(r.keepers, service.ID)
+	}
+	delete(r.services, service.ID)
+	r.mu.Unlock()
+
 	for _, endpoint := range service.Endpoints {
-		u, err := url.Parse(endpoint)
-		if err != nil {
-			return err
-		}
-		host, port, err := net.SplitHostPort(u.Host)
+		e, err := registry.ParseEndpoint(endpoint)
 		if err != nil {
 			return err
 		}
-		p, err := strconv.Atoi(port)
-		if err != nil {
-			return err
-		}
-		if _, err = r.cli.DeregisterInstance(vo.DeregisterInstanceParam{
-			Ip:          host,
-			Port:        uint64(p),
-			ServiceName: service.Name + "." + u.Scheme,
+		start := time.Now()
+		_, err = r.cli.DeregisterInstance(vo.DeregisterInstanceParam{
+			Ip:          e.Host,
+			Port:        uint64(e.Port),
+			ServiceName: service.Name + "." + e.Scheme,
 			GroupName:   r.opts.group,
 			Cluster:     r.opts.cluster,
 			Ephemeral:   true,
-		}); err != nil {
+		})
+		r.opts.metrics.Request(backend, "deregister", start)
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Watch creates a watcher according to the service name.
+// Watch creates a watcher according to the service name, the watcher is stopped when the registry is closed.
 func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
-	return newWatcher(ctx, r.cli, serviceName, r.opts.group, r.opts.kind, []string{r.opts.cluster})
+	w, err := newWatcher(ctx, r.cli, serviceName, r.opts.group, r.opts.kind, []string{r.opts.cluster}, r.opts.metrics)
+	if err != nil {
+		w.cancel()
+		return nil, err
+	}
+	go w.stopWhenDone(r.ctx)
+	return w, nil
+}
+
+// Close stops the watchers and closes the nacos client, the registered ephemeral instances expire
+// without heartbeats of the client.
+func (r *Registry) Close() error {
+	r.cancel()
+	r.cli.CloseClient()
+	return nil
 }
 
 // GetService return the service instances in memory according to the service name.
 func (r *Registry) GetService(_ context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	start := time.Now()
 	res, err := r.cli.SelectInstances(vo.SelectInstancesParam{
 		ServiceName: serviceName,
 		GroupName:   r.opts.group,
 		HealthyOnly: true,
 	})
+	r.opts.metrics.Request(backend, "get_service", start)
 	if err != nil {
 		return nil, err
 	}
 	items := make([]*registry.ServiceInstance, 0, len(res))
 	for _, in := range res {
-		kind := r.opts.kind
-		id := in.InstanceId
-		if in.Metadata != nil {
-			if k, ok := in.Metadata["kind"]; ok {
-				kind = k
-			}
-			if v, ok := in.Metadata["id"]; ok {
-				id = v
-				delete(in.Metadata, "id")
-			}
-		}
-		items = append(items, &registry.ServiceInstance{
-			ID:        id,
-			Name:      in.ServiceName,
-			Version:   in.Metadata["version"],
-			Metadata:  in.Metadata,
-			Endpoints: []string{fmt.Sprintf("%s://%s:%d", kind, in.Ip, in.Port)},
-		})
+		items = append(items, newServiceInstance(in, in.ServiceName, r.opts.kind))
 	}
 	return items, nil
 }
+
+// newServiceInstance converts the nacos instance to service instance, the endpoint is the registered one
+// in metadata, or made up of kind, ip and port of the instance registered by other clients.
+func newServiceInstance(in model.Instance, name string, defaultKind string) *registry.ServiceInstance {
+	kind := defaultKind
+	id := in.InstanceId
+	endpoint := ""
+	if in.Metadata != nil {
+		if k, ok := in.Metadata["kind"]; ok {
+			kind = k
+		}
+		if v, ok := in.Metadata["id"]; ok {
+			id = v
+			delete(in.Metadata, "id")
+		}
+		if v, ok := in.Metadata[metadataKeyEndpoint]; ok {
+			endpoint = v
+			delete(in.Metadata, metadataKeyEndpoint)
+		}
+	}
+	if endpoint == "" {
+		endpoint = registry.NewEndpoint(kind, in.Ip, int(in.Port), false).String()
+	}
+	return &registry.ServiceInstance{
+		ID:        id,
+		Name:      name,
+		Version:   in.Metadata["version"],
+		Metadata:  in.Metadata,
+		Endpoints: []string{endpoint},
+	}
+}
+
+// GetConfig returns the configuration of the service stored in the metadata of its instances,
+// the metadata key is the config key, the first non-empty value is returned.
+func (r *Registry) GetConfig(_ context.Context, serviceName string, key string) (string, error) {
+	start := time.Now()
+	res, err := r.cli.SelectInstances(vo.SelectInstancesParam{
+		ServiceName: serviceName,
+		GroupName:   r.opts.group,
+		HealthyOnly: true,
+	})
+	r.opts.metrics.Request(backend, "get_config", start)
+	if err != nil {
+		return "", err
+	}
+	for _, in := range res {
+		if v := in.Metadata[key]; v != "" {
+			return v, nil
+		}
+	}
+	return "", nil
+}
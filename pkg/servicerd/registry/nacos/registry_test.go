@@ -2,10 +2,16 @@ package nacos
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/registrytest"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
 )
 
 func TestNewRegistry(t *testing.T) {
@@ -51,6 +57,16 @@ func TestRegistry(t *testing.T) {
 	t.Log(err)
 }
 
+func TestUpdate(t *testing.T) {
+	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"},
+		registry.WithMetadata(map[string]string{registry.MetadataKeyWeight: "50"}))
+	r := newNacosRegistry()
+
+	defer func() { recover() }()
+	err := r.Update(context.Background(), instance)
+	t.Log(err)
+}
+
 func TestDeregister(t *testing.T) {
 	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
 	r := newNacosRegistry()
@@ -67,3 +83,176 @@ func TestGetService(t *testing.T) {
 	_, err := r.GetService(context.Background(), "foo")
 	t.Log(err)
 }
+
+func TestGetConfig(t *testing.T) {
+	r := newNacosRegistry()
+
+	defer func() { recover() }()
+	_, err := r.GetConfig(context.Background(), "foo", registry.ConfigKeyServiceConfig)
+	t.Log(err)
+}
+
+func Test_newServiceInstance(t *testing.T) {
+	r := newNacosRegistry()
+	si := registry.NewServiceInstance("foo", "bar", []string{"grpc://[::1]:8282?isSecure=true&zone=a"})
+	in, err := r.newInstance(si, si.Endpoints[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := newServiceInstance(model.Instance{Ip: in.host, Port: in.port, Metadata: in.metadata}, "bar", "grpc")
+	if got.ID != si.ID || got.Endpoints[0] != si.Endpoints[0] {
+		t.Fatalf("got %+v, want %+v", got, si)
+	}
+
+	got = newServiceInstance(model.Instance{InstanceId: "id", Ip: "::1", Port: 8282}, "bar", "grpc")
+	if got.Endpoints[0] != "grpc://[::1]:8282" {
+		t.Fatalf("got endpoint %s", got.Endpoints[0])
+	}
+}
+
+type fakeNamingClient struct {
+	naming_client.INamingClient
+	mu       sync.Mutex
+	callback func(services []model.Instance, err error)
+	closed   bool
+}
+
+func (c *fakeNamingClient) Subscribe(param *vo.SubscribeParam) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callback = param.SubscribeCallback
+	return nil
+}
+
+func (c *fakeNamingClient) Unsubscribe(*vo.SubscribeParam) error {
+	return nil
+}
+
+func (c *fakeNamingClient) CloseClient() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+func TestRegistry_Close(t *testing.T) {
+	const pkg = "github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/nacos"
+	before := registrytest.Goroutines(pkg)
+	cli := &fakeNamingClient{}
+	r := New(cli)
+
+	w, err := r.Watch(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// notifications do not block the nacos client
+	cli.callback(nil, nil)
+	cli.callback(nil, nil)
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	registrytest.WaitGoroutines(t, pkg, before)
+	if _, err = w.Next(); err == nil {
+		t.Fatal("expected error after close")
+	}
+	if !cli.closed {
+		t.Fatal("nacos client is not closed")
+	}
+}
+
+func TestRegistry_Hooks(t *testing.T) {
+	server := newFakeNacos()
+	events := make(chan string, 10)
+	r := New(&fakeNacosClient{server: server}, WithHooks(&registry.Hooks{
+		OnRegistered:   func(*registry.ServiceInstance) { events <- registry.EventRegistered },
+		OnLeaseLost:    func(*registry.ServiceInstance, error) { events <- registry.EventLeaseLost },
+		OnReRegistered: func(*registry.ServiceInstance) { events <- registry.EventReRegistered },
+		OnGiveUp:       func(*registry.ServiceInstance, error) { events <- registry.EventGiveUp },
+	}))
+	defer r.Close() //nolint
+	r.opts.checkInterval = time.Millisecond * 50
+
+	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
+	if err := r.Register(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent := func(want string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got event %s, want %s", got, want)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for event %s", want)
+		}
+	}
+	waitEvent(registry.EventRegistered)
+
+	// removed by nacos
+	key := groupedName(r.opts.group, "bar.grpc")
+	server.change(key, func(instances map[string]model.Instance) { delete(instances, "127.0.0.1:8282") })
+	waitEvent(registry.EventLeaseLost)
+	waitEvent(registry.EventReRegistered)
+
+	// nacos rejects the registrations
+	server.change(key, func(instances map[string]model.Instance) {
+		delete(instances, "127.0.0.1:8282")
+		server.failures = 5
+	})
+	waitEvent(registry.EventLeaseLost)
+	waitEvent(registry.EventGiveUp)
+
+	// no checks after deregistration
+	if err := r.Deregister(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	n := len(r.keepers)
+	r.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d registrations are still checked", n)
+	}
+}
+
+func TestRegistry_HooksAfterDrain(t *testing.T) {
+	server := newFakeNacos()
+	reregistered := make(chan struct{}, 1)
+	r := New(&fakeNacosClient{server: server}, WithHooks(&registry.Hooks{
+		OnReRegistered: func(*registry.ServiceInstance) { reregistered <- struct{}{} },
+	}))
+	defer r.Close() //nolint
+	r.opts.checkInterval = time.Millisecond * 50
+
+	instance := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"})
+	if err := r.Register(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	updated := registry.NewServiceInstance("foo", "bar", []string{"grpc://127.0.0.1:8282"},
+		registry.WithVersion("v2"))
+	if err := r.Update(context.Background(), updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Drain(context.Background(), updated); err != nil {
+		t.Fatal(err)
+	}
+
+	// removed by nacos and registered again by the keeper
+	key := groupedName(r.opts.group, "bar.grpc")
+	server.change(key, func(instances map[string]model.Instance) { delete(instances, "127.0.0.1:8282") })
+	select {
+	case <-reregistered:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the registration again")
+	}
+
+	server.mu.Lock()
+	in, ok := server.services[key]["127.0.0.1:8282"]
+	server.mu.Unlock()
+	if !ok {
+		t.Fatal("instance is not registered again")
+	}
+	if in.Enable || in.Metadata[registry.MetadataKeyStatus] != registry.StatusDraining || in.Metadata["version"] != "v2" {
+		t.Fatalf("registered again with enable=%v, metadata %v, want the drained v2 instance", in.Enable, in.Metadata)
+	}
+}
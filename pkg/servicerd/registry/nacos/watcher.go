@@ -2,8 +2,10 @@ package nacos
 
 import (
 	"context"
-	"fmt"
+	"sync"
+	"time"
 
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/metrics"
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
 
 	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
@@ -20,73 +22,91 @@ type watcher struct {
 	ctx         context.Context
 	cancel      context.CancelFunc
 	watchChan   chan struct{}
+	subscribe   *vo.SubscribeParam // the same param unsubscribes the callback
 	cli         naming_client.INamingClient
 	kind        string
+	metrics     *metrics.Metrics
+	failed      bool
+	stopOnce    sync.Once
 }
 
-func newWatcher(ctx context.Context, cli naming_client.INamingClient, serviceName, groupName, kind string, clusters []string) (*watcher, error) {
+func newWatcher(ctx context.Context, cli naming_client.INamingClient, serviceName, groupName, kind string, clusters []string, m *metrics.Metrics) (*watcher, error) {
 	w := &watcher{
 		serviceName: serviceName,
 		clusters:    clusters,
 		groupName:   groupName,
 		cli:         cli,
 		kind:        kind,
+		metrics:     m,
 		watchChan:   make(chan struct{}, 1),
 	}
 	w.ctx, w.cancel = context.WithCancel(ctx)
 
-	e := w.cli.Subscribe(&vo.SubscribeParam{
+	w.subscribe = &vo.SubscribeParam{
 		ServiceName: serviceName,
 		GroupName:   groupName,
 		SubscribeCallback: func(services []model.Instance, err error) {
-			w.watchChan <- struct{}{}
+			// a pending notification covers this one, do not block the callback of nacos client
+			select {
+			case w.watchChan <- struct{}{}:
+			default:
+			}
 		},
-	})
+	}
+	e := w.cli.Subscribe(w.subscribe)
 	return w, e
 }
 
 func (w *watcher) Next() ([]*registry.ServiceInstance, error) {
+	if err := w.ctx.Err(); err != nil {
+		return nil, err
+	}
 	select {
 	case <-w.ctx.Done():
 		return nil, w.ctx.Err()
 	case <-w.watchChan:
 	}
+	start := time.Now()
 	res, err := w.cli.GetService(vo.GetServiceParam{
 		ServiceName: w.serviceName,
 		GroupName:   w.groupName,
 	})
+	w.metrics.Request(backend, "get_service", start)
 	if err != nil {
+		w.failed = true
+		w.metrics.WatcherError(backend, w.serviceName)
 		return nil, err
 	}
+	if w.failed {
+		w.failed = false
+		w.metrics.WatcherReconnect(backend, w.serviceName)
+	}
 	items := make([]*registry.ServiceInstance, 0, len(res.Hosts))
 	for _, in := range res.Hosts {
-		kind := w.kind
-		id := in.InstanceId
-		if in.Metadata != nil {
-			if k, ok := in.Metadata["kind"]; ok {
-				kind = k
-			}
-			if v, ok := in.Metadata["id"]; ok {
-				id = v
-				delete(in.Metadata, "id")
-			}
+		si := newServiceInstance(in, res.Name, w.kind)
+		if !in.Enable {
+			// deliver the disabled instance as draining, the resolvers push an empty state when all are draining
+			si = registry.Draining(si)
 		}
-		items = append(items, &registry.ServiceInstance{
-			ID:        id,
-			Name:      res.Name,
-			Version:   in.Metadata["version"],
-			Metadata:  in.Metadata,
-			Endpoints: []string{fmt.Sprintf("%s://%s:%d", kind, in.Ip, in.Port)},
-		})
+		items = append(items, si)
 	}
 	return items, nil
 }
 
 func (w *watcher) Stop() error {
-	w.cancel()
-	return w.cli.Unsubscribe(&vo.SubscribeParam{
-		ServiceName: w.serviceName,
-		GroupName:   w.groupName,
-		Clusters:    w.clusters,
+	var err error
+	w.stopOnce.Do(func() {
+		w.cancel()
+		err = w.cli.Unsubscribe(w.subscribe)
 	})
+	return err
+}
+
+// stopWhenDone stops the watcher when ctx is done, it returns when the watcher is stopped.
+func (w *watcher) stopWhenDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		_ = w.Stop()
+	case <-w.ctx.Done():
+	}
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/zhufuyi/dtmdriver-sponge/pkg/nacoscli"
 
 	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
 )
 
 func getCli() naming_client.INamingClient {
@@ -35,6 +36,7 @@ func newWatch() *watcher {
 		watchChan:   make(chan struct{}),
 		cli:         getCli(),
 		kind:        "host",
+		subscribe:   &vo.SubscribeParam{ServiceName: "host", GroupName: "foo"},
 	}
 
 	return wt
@@ -42,7 +44,7 @@ func newWatch() *watcher {
 
 func Test_watcher(t *testing.T) {
 	defer func() { recover() }()
-	_, _ = newWatcher(context.Background(), getCli(), "host", "host", "foo", []string{"bar"})
+	_, _ = newWatcher(context.Background(), getCli(), "host", "host", "foo", []string{"bar"}, nil)
 
 	w := newWatch()
 	_, err := w.Next()
@@ -1,7 +1,10 @@
 // Package registry is service registry library, supports etcd, consul and nacos.
 package registry
 
-import "context"
+import (
+	"context"
+	"errors"
+)
 
 // Registry is service registrar.
 type Registry interface {
@@ -19,6 +22,59 @@ type Discovery interface {
 	Watch(ctx context.Context, serviceName string) (Watcher, error)
 }
 
+// Updater is implemented by the registries which update a registered instance in place.
+type Updater interface {
+	// Update the version and metadata of the registered instance without deregistering it.
+	Update(ctx context.Context, service *ServiceInstance) error
+}
+
+// ErrUpdateNotSupported is returned by the middlewares if the wrapped registry does not implement Updater.
+var ErrUpdateNotSupported = errors.New("registry: update is not supported")
+
+// Drainer is implemented by the registries which take a registered instance out of rotation without
+// deregistering it, e.g. before the instance is stopped.
+type Drainer interface {
+	// Drain marks the registered instance as draining, discoveries stop resolving it.
+	Drain(ctx context.Context, service *ServiceInstance) error
+}
+
+// ErrDrainNotSupported is returned by the middlewares if the wrapped registry does not implement Drainer.
+var ErrDrainNotSupported = errors.New("registry: drain is not supported")
+
+const (
+	// MetadataKeyStatus is the metadata key of the instance status.
+	MetadataKeyStatus = "status"
+	// StatusDraining is the status of a draining instance, it is excluded by the resolvers.
+	StatusDraining = "draining"
+)
+
+// Draining returns a copy of the instance with the draining status in metadata.
+func Draining(service *ServiceInstance) *ServiceInstance {
+	in := *service
+	in.Metadata = make(map[string]string, len(service.Metadata)+1)
+	for k, v := range service.Metadata {
+		in.Metadata[k] = v
+	}
+	in.Metadata[MetadataKeyStatus] = StatusDraining
+	return &in
+}
+
+// MetadataKeyWeight is the metadata key of the instance weight, it is used as the instance weight by nacos.
+const MetadataKeyWeight = "weight"
+
+const (
+	// ConfigKeyServiceConfig is the config key of the grpc service config in json.
+	ConfigKeyServiceConfig = "service_config"
+	// ConfigKeyTrafficSplit is the config key of the traffic split rule by version, e.g. v1:90,v2:10
+	ConfigKeyTrafficSplit = "traffic_split"
+)
+
+// ConfigGetter is implemented by the discoveries which store configurations of services.
+type ConfigGetter interface {
+	// GetConfig returns the configuration of the service by key, empty if not found.
+	GetConfig(ctx context.Context, serviceName string, key string) (string, error)
+}
+
 // Watcher is service watcher.
 type Watcher interface {
 	// Next returns services in the following two cases:
@@ -47,7 +103,7 @@ type ServiceInstance struct {
 	Endpoints []string `json:"endpoints"`
 }
 
-// NewServiceInstance creates a new instance
+// NewServiceInstance creates a new instance, the registries validate it with Validate before registering it.
 func NewServiceInstance(id string, name string, endpoints []string, opts ...Option) *ServiceInstance {
 	o := defaultOptions()
 	o.apply(opts...)
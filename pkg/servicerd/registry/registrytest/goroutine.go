@@ -0,0 +1,51 @@
+package registrytest
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Goroutines returns the number of goroutines running or created by the functions of package pkg,
+// pkg is the import path, e.g. github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/etcd.
+func Goroutines(pkg string) int {
+	return len(goroutines(pkg))
+}
+
+// WaitGoroutines waits for the goroutines of package pkg to drop to n, the goroutines of other packages are
+// ignored, so that the tests running in parallel do not affect the result.
+func WaitGoroutines(t *testing.T, pkg string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for {
+		stacks := goroutines(pkg)
+		if len(stacks) <= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines of %s leaked: %d > %d\n%s", pkg, len(stacks), n, strings.Join(stacks, "\n\n"))
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+// goroutines returns the stacks of the goroutines whose functions or creators are in package pkg.
+func goroutines(pkg string) []string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	var stacks []string
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(stack, pkg+".") {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks
+}
@@ -0,0 +1,15 @@
+package registrytest
+
+import "testing"
+
+func TestWaitGoroutines(t *testing.T) {
+	const pkg = "github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry/registrytest"
+	before := Goroutines(pkg)
+	stop := make(chan struct{})
+	go func() { <-stop }()
+	if n := Goroutines(pkg); n != before+1 {
+		t.Fatalf("got %d goroutines, want %d", n, before+1)
+	}
+	close(stop)
+	WaitGoroutines(t, pkg, before)
+}
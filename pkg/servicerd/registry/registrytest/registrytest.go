@@ -0,0 +1,437 @@
+// Package registrytest is a conformance test suite of registry backends,
+// a backend certifies against the contract of Registry, Discovery and Watcher with RunConformance.
+package registrytest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/discovery"
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Timeout is the time to wait for a change to be visible to discoveries and watchers.
+var Timeout = time.Second * 10
+
+// Backend is a registry backend under test, the registries and the discovery share the same store.
+type Backend struct {
+	// NewRegistry creates a registry, every instance is registered by its own registry like a service process.
+	NewRegistry func() registry.Registry
+	Discovery   registry.Discovery
+	// ServiceName returns the name to discover the instances registered with name, nil means the same name.
+	ServiceName func(name string) string
+
+	mu         sync.Mutex
+	registries map[string]registry.Registry // registry of instance id
+}
+
+func (b *Backend) serviceName(name string) string {
+	if b.ServiceName == nil {
+		return name
+	}
+	return b.ServiceName(name)
+}
+
+// Factory creates a backend with an empty store, the resources of the backend are released by t.Cleanup.
+type Factory func(t *testing.T) *Backend
+
+// RunConformance runs the conformance tests against the backends created by factory, every test has its own backend.
+//
+// The contract:
+//   - the first Next of a watcher returns the registered instances if there are any.
+//   - Next returns the instances after registrations, updates and deregistrations.
+//   - GetService returns the registered instances while the service is watched.
+//   - all watchers of a service are notified.
+//   - Stop unblocks Next, and cancelling the context of Watch unblocks Next.
+//   - the resolvers push an empty state after all instances are drained, if the registry implements Drainer.
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, b *Backend)
+	}{
+		{"FirstNext", testFirstNext},
+		{"RegisterNotification", testRegisterNotification},
+		{"DeregisterVisibility", testDeregisterVisibility},
+		{"GetService", testGetService},
+		{"ConcurrentWatchers", testConcurrentWatchers},
+		{"StopUnblocksNext", testStopUnblocksNext},
+		{"ContextCancellation", testContextCancellation},
+		{"DrainAll", testDrainAll},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, factory(t))
+		})
+	}
+}
+
+func newInstance(id string, name string, port int) *registry.ServiceInstance {
+	return registry.NewServiceInstance(id, name, []string{fmt.Sprintf("grpc://127.0.0.1:%d", port)},
+		registry.WithVersion("v1.0.0"),
+		registry.WithMetadata(map[string]string{"zone": "a"}),
+	)
+}
+
+func register(t *testing.T, b *Backend, instances ...*registry.ServiceInstance) {
+	t.Helper()
+	for _, in := range instances {
+		r := b.NewRegistry()
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		err := r.Register(ctx, in)
+		cancel()
+		if err != nil {
+			t.Fatalf("Register(%s) error: %v", in.ID, err)
+		}
+		b.mu.Lock()
+		if b.registries == nil {
+			b.registries = make(map[string]registry.Registry)
+		}
+		b.registries[in.ID] = r
+		b.mu.Unlock()
+
+		in := in
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+			defer cancel()
+			_ = r.Deregister(ctx, in)
+		})
+	}
+}
+
+func deregister(t *testing.T, b *Backend, in *registry.ServiceInstance) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	b.mu.Lock()
+	r := b.registries[in.ID]
+	b.mu.Unlock()
+	if r == nil {
+		t.Fatalf("%s is not registered", in.ID)
+	}
+	if err := r.Deregister(ctx, in); err != nil {
+		t.Fatalf("Deregister(%s) error: %v", in.ID, err)
+	}
+}
+
+// watchResult is the result of a Next.
+type watchResult struct {
+	instances []*registry.ServiceInstance
+	err       error
+}
+
+// collect calls Next of the watcher until it returns an error, the results are sent to the returned channel.
+func collect(w registry.Watcher) <-chan watchResult {
+	ch := make(chan watchResult, 16)
+	go func() {
+		defer close(ch)
+		for {
+			ins, err := w.Next()
+			ch <- watchResult{instances: ins, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func watch(t *testing.T, b *Backend, name string) (registry.Watcher, <-chan watchResult) {
+	t.Helper()
+	w, err := b.Discovery.Watch(context.Background(), b.serviceName(name))
+	if err != nil {
+		t.Fatalf("Watch(%s) error: %v", name, err)
+	}
+	t.Cleanup(func() { _ = w.Stop() })
+	return w, collect(w)
+}
+
+// waitIDs waits until Next returns the instances of ids.
+func waitIDs(t *testing.T, ch <-chan watchResult, ids ...string) []*registry.ServiceInstance {
+	t.Helper()
+	instances, err := nextIDs(ch, ids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instances
+}
+
+// nextIDs waits until Next returns the instances of ids, it can be called by the goroutines of a test.
+func nextIDs(ch <-chan watchResult, ids ...string) ([]*registry.ServiceInstance, error) {
+	want := strings.Join(sorted(ids), ",")
+	var got string
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case r, ok := <-ch:
+			if !ok {
+				return nil, fmt.Errorf("watcher stopped, last instances [%s], want [%s]", got, want)
+			}
+			if r.err != nil {
+				return nil, fmt.Errorf("Next error: %v", r.err)
+			}
+			got = strings.Join(instanceIDs(r.instances), ",")
+			if got == want {
+				return r.instances, nil
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("timeout, last instances [%s], want [%s]", got, want)
+		}
+	}
+}
+
+// waitErr waits until Next returns an error.
+func waitErr(t *testing.T, ch <-chan watchResult) {
+	t.Helper()
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case r, ok := <-ch:
+			if !ok || r.err != nil {
+				return
+			}
+		case <-timer.C:
+			t.Fatal("Next is not unblocked")
+		}
+	}
+}
+
+func instanceIDs(instances []*registry.ServiceInstance) []string {
+	ids := make([]string, 0, len(instances))
+	for _, in := range instances {
+		ids = append(ids, in.ID)
+	}
+	return sorted(ids)
+}
+
+func sorted(ss []string) []string {
+	ss = append([]string{}, ss...)
+	sort.Strings(ss)
+	return ss
+}
+
+// checkInstance checks the fields of the discovered instance are the same as the registered one.
+func checkInstance(t *testing.T, got *registry.ServiceInstance, want *registry.ServiceInstance) {
+	t.Helper()
+	if got.ID != want.ID || got.Version != want.Version {
+		t.Errorf("got instance %s %s, want %s %s", got.ID, got.Version, want.ID, want.Version)
+	}
+	if strings.Join(got.Endpoints, ",") != strings.Join(want.Endpoints, ",") {
+		t.Errorf("got endpoints %v, want %v", got.Endpoints, want.Endpoints)
+	}
+	for k, v := range want.Metadata {
+		if got.Metadata[k] != v {
+			t.Errorf("got metadata %s=%s, want %s", k, got.Metadata[k], v)
+		}
+	}
+}
+
+func testFirstNext(t *testing.T, b *Backend) {
+	in := newInstance("first-1", "first", 9001)
+	register(t, b, in)
+
+	_, ch := watch(t, b, "first")
+	instances := waitIDs(t, ch, in.ID)
+	checkInstance(t, instances[0], in)
+}
+
+func testRegisterNotification(t *testing.T, b *Backend) {
+	in1 := newInstance("notify-1", "notify", 9001)
+	in2 := newInstance("notify-2", "notify", 9002)
+	register(t, b, in1)
+
+	_, ch := watch(t, b, "notify")
+	waitIDs(t, ch, in1.ID)
+
+	register(t, b, in2)
+	waitIDs(t, ch, in1.ID, in2.ID)
+}
+
+func testDeregisterVisibility(t *testing.T, b *Backend) {
+	in1 := newInstance("deregister-1", "deregister", 9001)
+	in2 := newInstance("deregister-2", "deregister", 9002)
+	register(t, b, in1, in2)
+
+	_, ch := watch(t, b, "deregister")
+	waitIDs(t, ch, in1.ID, in2.ID)
+
+	deregister(t, b, in2)
+	waitIDs(t, ch, in1.ID)
+
+	deregister(t, b, in1)
+	waitIDs(t, ch)
+}
+
+func testGetService(t *testing.T, b *Backend) {
+	in := newInstance("get-1", "get", 9001)
+	register(t, b, in)
+
+	// some backends only resolve watched services
+	_, ch := watch(t, b, "get")
+	waitIDs(t, ch, in.ID)
+
+	deadline := time.Now().Add(Timeout)
+	for {
+		instances, err := b.Discovery.GetService(context.Background(), b.serviceName("get"))
+		if err == nil && len(instances) == 1 {
+			checkInstance(t, instances[0], in)
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GetService() = %v, %v, want [%s]", instanceIDs(instances), err, in.ID)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func testConcurrentWatchers(t *testing.T, b *Backend) {
+	in1 := newInstance("concurrent-1", "concurrent", 9001)
+	in2 := newInstance("concurrent-2", "concurrent", 9002)
+	register(t, b, in1)
+
+	const n = 5
+	chs := make([]<-chan watchResult, n)
+	for i := range chs {
+		_, chs[i] = watch(t, b, "concurrent")
+	}
+	waitAll(t, chs, in1.ID)
+
+	register(t, b, in2)
+	waitAll(t, chs, in1.ID, in2.ID)
+}
+
+// waitAll waits until Next of all watchers returns the instances of ids concurrently,
+// the errors are reported by the test goroutine.
+func waitAll(t *testing.T, chs []<-chan watchResult, ids ...string) {
+	t.Helper()
+	errs := make(chan error, len(chs))
+	for _, ch := range chs {
+		go func(ch <-chan watchResult) {
+			_, err := nextIDs(ch, ids...)
+			errs <- err
+		}(ch)
+	}
+	for range chs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testStopUnblocksNext(t *testing.T, b *Backend) {
+	in := newInstance("stop-1", "stop", 9001)
+	register(t, b, in)
+
+	w, ch := watch(t, b, "stop")
+	waitIDs(t, ch, in.ID)
+
+	// Next is blocked without changes
+	time.Sleep(time.Millisecond * 100)
+	if err := w.Stop(); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	waitErr(t, ch)
+}
+
+func testContextCancellation(t *testing.T, b *Backend) {
+	in := newInstance("cancel-1", "cancel", 9001)
+	register(t, b, in)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := b.Discovery.Watch(ctx, b.serviceName("cancel"))
+	if err != nil {
+		cancel()
+		t.Fatalf("Watch error: %v", err)
+	}
+	t.Cleanup(func() { _ = w.Stop() })
+	ch := collect(w)
+	waitIDs(t, ch, in.ID)
+
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	waitErr(t, ch)
+}
+
+// stateConn records the states pushed by a resolver.
+type stateConn struct {
+	resolver.ClientConn
+	mu     sync.Mutex
+	states []resolver.State
+}
+
+func (c *stateConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = append(c.states, state)
+	return nil
+}
+
+func (c *stateConn) ReportError(error) {}
+
+func (c *stateConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+// waitAddrs waits until the last pushed state has n addresses.
+func (c *stateConn) waitAddrs(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for {
+		c.mu.Lock()
+		got := -1
+		if len(c.states) > 0 {
+			got = len(c.states[len(c.states)-1].Addresses)
+		}
+		c.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d addresses in the last state, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func testDrainAll(t *testing.T, b *Backend) {
+	in1 := newInstance("drain-1", "drain", 9001)
+	in2 := newInstance("drain-2", "drain", 9002)
+	register(t, b, in1, in2)
+
+	cc := &stateConn{}
+	target := resolver.Target{URL: url.URL{Scheme: "discovery", Path: "/" + b.serviceName("drain")}}
+	r, err := discovery.NewBuilder(b.Discovery, discovery.WithInsecure(true), discovery.DisableDebugLog()).Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("Build error: %v", err)
+	}
+	defer r.Close()
+	cc.waitAddrs(t, 2)
+
+	for _, in := range []*registry.ServiceInstance{in1, in2} {
+		b.mu.Lock()
+		d, ok := b.registries[in.ID].(registry.Drainer)
+		b.mu.Unlock()
+		if !ok {
+			t.Skip("the registry does not implement Drainer")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		err = d.Drain(ctx, in)
+		cancel()
+		if err != nil {
+			t.Fatalf("Drain(%s) error: %v", in.ID, err)
+		}
+	}
+	// the clients stop sending requests to the drained instances
+	cc.waitAddrs(t, 0)
+}
@@ -0,0 +1,118 @@
+package registrytest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+)
+
+// memStore is an in-memory backend, it is the reference implementation of the contract.
+type memStore struct {
+	mu        sync.Mutex
+	instances map[string]map[string]*registry.ServiceInstance // name -> id -> instance
+	watchers  map[*memWatcher]struct{}
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		instances: make(map[string]map[string]*registry.ServiceInstance),
+		watchers:  make(map[*memWatcher]struct{}),
+	}
+}
+
+func (s *memStore) Register(_ context.Context, service *registry.ServiceInstance) error {
+	if err := service.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instances[service.Name] == nil {
+		s.instances[service.Name] = make(map[string]*registry.ServiceInstance)
+	}
+	s.instances[service.Name][service.ID] = service
+	s.notify(service.Name)
+	return nil
+}
+
+func (s *memStore) Deregister(_ context.Context, service *registry.ServiceInstance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances[service.Name], service.ID)
+	s.notify(service.Name)
+	return nil
+}
+
+func (s *memStore) Drain(ctx context.Context, service *registry.ServiceInstance) error {
+	return s.Register(ctx, registry.Draining(service))
+}
+
+// notify notifies the watchers of the service, the caller must hold the lock.
+func (s *memStore) notify(name string) {
+	for w := range s.watchers {
+		if w.name == name {
+			select {
+			case w.event <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (s *memStore) GetService(_ context.Context, name string) ([]*registry.ServiceInstance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instances := make([]*registry.ServiceInstance, 0, len(s.instances[name]))
+	for _, in := range s.instances[name] {
+		instances = append(instances, in)
+	}
+	return instances, nil
+}
+
+func (s *memStore) Watch(ctx context.Context, name string) (registry.Watcher, error) {
+	w := &memWatcher{s: s, name: name, event: make(chan struct{}, 1)}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers[w] = struct{}{}
+	if len(s.instances[name]) > 0 {
+		w.event <- struct{}{}
+	}
+	return w, nil
+}
+
+type memWatcher struct {
+	s      *memStore
+	name   string
+	event  chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (w *memWatcher) Next() ([]*registry.ServiceInstance, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	case <-w.event:
+	}
+	return w.s.GetService(w.ctx, w.name)
+}
+
+func (w *memWatcher) Stop() error {
+	w.cancel()
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	delete(w.s.watchers, w)
+	return nil
+}
+
+func TestRunConformance(t *testing.T) {
+	RunConformance(t, func(t *testing.T) *Backend {
+		s := newMemStore()
+		return &Backend{
+			NewRegistry: func() registry.Registry { return s },
+			Discovery:   s,
+		}
+	})
+}
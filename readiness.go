@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zhufuyi/dtmdriver-sponge/pkg/servicerd/registry"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// ReadinessProbe returns nil if the server listening on addr accepts requests.
+type ReadinessProbe func(ctx context.Context, addr string) error
+
+// TCPProbe is ready when addr accepts tcp connections.
+func TCPProbe() ReadinessProbe {
+	return func(ctx context.Context, addr string) error {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// GRPCHealthProbe is ready when the service of the grpc server on addr is serving, empty service means the whole
+// server. A server without the grpc.health.v1 service is ready once it accepts requests. The server is dialled
+// with opts, e.g. grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), plaintext if opts is empty.
+func GRPCHealthProbe(service string, opts ...grpc.DialOption) ReadinessProbe {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	return func(ctx context.Context, addr string) error {
+		conn, err := grpc.DialContext(ctx, addr, opts...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close() //nolint
+
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			if status.Code(err) == codes.Unimplemented {
+				return nil
+			}
+			return err
+		}
+		if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("%s is %s", addr, resp.Status)
+		}
+		return nil
+	}
+}
+
+// defaultReadinessTimeout is the readiness timeout if it is not set.
+const defaultReadinessTimeout = time.Second * 30
+
+// waitReady waits for the ready signal, then probes the endpoint with backoff until it is ready,
+// the probe gives up when the readiness timeout passes.
+func (o *options) waitReady(endpoint string) error {
+	if o.readySignal != nil {
+		<-o.readySignal
+	}
+	if o.readinessProbe == nil {
+		return nil
+	}
+
+	addr, err := probeAddr(endpoint)
+	if err != nil {
+		return err
+	}
+	timeout := o.readinessTimeout
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	backoff := time.Millisecond * 100
+	for {
+		probeCtx, probeCancel := context.WithTimeout(ctx, time.Second*3)
+		err = o.readinessProbe(probeCtx, addr)
+		probeCancel()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("endpoint %s is not ready: %v", endpoint, err)
+		case <-time.After(backoff):
+		}
+		if backoff < time.Second*2 {
+			backoff *= 2
+		}
+	}
+}
+
+// probeAddr returns the local address of the endpoint, the unspecified host is probed on loopback.
+func probeAddr(endpoint string) (string, error) {
+	e, err := registry.ParseEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(e.Host); e.Host == "" || (ip != nil && ip.IsUnspecified()) {
+		e.Host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			e.Host = "::1"
+		}
+	}
+	return e.Address(), nil
+}
+
+// registrationFailed logs the error of the asynchronous registration and sends it to the registration errors.
+func (o *options) registrationFailed(err error) {
+	fmt.Printf("[driver] register dtm service failed: %v\n", err)
+	if o.registrationErrs == nil {
+		return
+	}
+	select {
+	case o.registrationErrs <- err:
+	default:
+	}
+}
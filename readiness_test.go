@@ -0,0 +1,120 @@
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func Test_probeAddr(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"grpc://0.0.0.0:36790", "127.0.0.1:36790"},
+		{"grpc://[::]:36790", "[::1]:36790"},
+		{"grpc://:36790", "127.0.0.1:36790"},
+		{"grpc://192.168.1.10:36790", "192.168.1.10:36790"},
+	}
+	for _, tt := range tests {
+		got, err := probeAddr(tt.endpoint)
+		if err != nil || got != tt.want {
+			t.Errorf("probeAddr(%s) = %s, %v, want %s", tt.endpoint, got, err, tt.want)
+		}
+	}
+}
+
+func Test_waitReady(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	// the server starts listening after the probe starts
+	hs := health.NewServer()
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, hs)
+	go func() {
+		time.Sleep(time.Millisecond * 300)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		_ = server.Serve(l)
+	}()
+	defer server.Stop()
+
+	o := defaultOptions()
+	WithReadinessProbe(GRPCHealthProbe(""), time.Second*5)(o)
+	if err = o.waitReady("grpc://" + addr); err != nil {
+		t.Fatal(err)
+	}
+
+	hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	WithReadinessProbe(GRPCHealthProbe(""), time.Millisecond*500)(o)
+	if err = o.waitReady("grpc://" + addr); err == nil {
+		t.Fatal("expected not ready error")
+	}
+
+	// 0 means the default timeout
+	hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	WithReadinessProbe(GRPCHealthProbe(""), 0)(o)
+	if err = o.waitReady("grpc://" + addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server is dialled with the dial options of probe
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	tlsProbe := GRPCHealthProbe("", grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})), grpc.WithBlock()) //nolint
+	if err = tlsProbe(ctx, addr); err == nil {
+		t.Fatal("expected error of probing the plaintext server with TLS")
+	}
+	if err = GRPCHealthProbe("", grpc.WithTransportCredentials(insecure.NewCredentials()))(context.Background(), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make(chan struct{})
+	WithReadinessProbe(TCPProbe(), time.Second)(o)
+	WithReadySignal(ready)(o)
+	done := make(chan error, 1)
+	go func() { done <- o.waitReady("grpc://" + addr) }()
+	select {
+	case <-done:
+		t.Fatal("ready before the signal")
+	case <-time.After(time.Millisecond * 100):
+	}
+	close(ready)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_registrationFailed(t *testing.T) {
+	o := defaultOptions()
+	o.registrationFailed(errors.New("not ready")) // no channel
+
+	errs := make(chan error, 1)
+	WithRegistrationErrors(errs)(o)
+	o.registrationFailed(errors.New("not ready"))
+	o.registrationFailed(errors.New("dropped")) // does not block when the channel is full
+	select {
+	case err := <-errs:
+		if err.Error() != "not ready" {
+			t.Errorf("got error %v, want not ready", err)
+		}
+	default:
+		t.Fatal("the error is not sent")
+	}
+}